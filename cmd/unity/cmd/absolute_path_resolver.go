@@ -45,3 +45,17 @@ func (a *absolutePathResolver) resolve(version, dir, workingDir, target string)
 	}
 	return a.cp.resolve(version, target)
 }
+
+func (a *absolutePathResolver) goModReplace(version, dir, workingDir string) (string, error) {
+	if !filepath.IsAbs(version) {
+		return "", errNoMatch
+	}
+	return a.cp.goModReplace(version)
+}
+
+func (a *absolutePathResolver) check(version string) error {
+	if !filepath.IsAbs(version) {
+		return errNoMatch
+	}
+	return nil
+}
@@ -16,6 +16,8 @@ package cmd
 
 import (
 	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"os"
@@ -85,6 +87,13 @@ func (bh *buildHelper) cueCloneDir() string {
 	return filepath.Join(bh.userCacheDir, clonesDir, "cue")
 }
 
+// corpusCloneDir returns the path at which, within the user cache dir, the
+// bare clone of the corpus project repository repo is maintained.
+func (bh *buildHelper) corpusCloneDir(repo string) string {
+	h := sha256.Sum256([]byte(repo))
+	return filepath.Join(bh.userCacheDir, clonesDir, "corpus", hex.EncodeToString(h[:8]))
+}
+
 // cueVersionHash is called by various resolvers to create a hash
 // based on a version. The various callers are responsible for
 // ensuring that version does/doesn't clash when expected
@@ -321,6 +330,12 @@ func (bh *buildHelper) buildAndCache(buildDir, target, main string) error {
 	return nil
 }
 
+// crossBuilding reports whether the target GOOS and GOARCH differ from those
+// of the host.
+func (bh *buildHelper) crossBuilding() bool {
+	return bh.targetGOOS != runtime.GOOS || bh.targetGOARCH != runtime.GOARCH
+}
+
 // buildEnv constructs environment variables required
 // for building self/CUE for running inside a docker
 // container
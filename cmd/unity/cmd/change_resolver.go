@@ -39,38 +39,60 @@ func newChangeResolver(c resolverConfig) (resolver, error) {
 	return res, nil
 }
 
-func (g *changeResolver) resolve(version, _, _, target string) (string, error) {
+func (g *changeResolver) resolve(version, _, working, target string) (string, error) {
+	strategy, err := g.strategy(version)
+	if err != nil {
+		return "", err
+	}
+	return g.cc.resolve(version, working, target, strategy)
+}
+
+func (g *changeResolver) goModReplace(version, _, working string) (string, error) {
+	strategy, err := g.strategy(version)
+	if err != nil {
+		return "", err
+	}
+	return g.cc.sourceWorktree(version, working, strategy)
+}
+
+func (g *changeResolver) check(version string) error {
+	_, err := g.strategy(version)
+	return err
+}
+
+// strategy returns the strategy for resolving version within the CUE clone.
+func (g *changeResolver) strategy(version string) (cueStrategy, error) {
 	if !strings.HasPrefix(version, changeVersionPrefix) {
-		return "", errNoMatch
+		return nil, errNoMatch
 	}
 	changeID, revisionID, found := strings.Cut(strings.TrimPrefix(version, changeVersionPrefix), "/")
 	if !found {
-		return "", errNoMatch
+		return nil, errNoMatch
 	}
-	return g.cc.resolve(version, target, func(c *commonCUEResolver) (string, error) {
+	return func(c *commonCUEResolver) (string, string, error) {
 		client, err := gerrit.NewClient("https://review.gerrithub.io", nil)
 		if err != nil {
-			return "", fmt.Errorf("failed to create Gerrit client: %v", err)
+			return "", "", fmt.Errorf("failed to create Gerrit client: %v", err)
 		}
 		change, _, err := client.Changes.GetChange(changeID, &gerrit.ChangeOptions{
 			AdditionalFields: []string{"ALL_REVISIONS"},
 		})
 		if err != nil {
-			return "", fmt.Errorf("failed to resolve revisions for %s: %v", changeID, err)
+			return "", "", fmt.Errorf("failed to resolve revisions for %s: %v", changeID, err)
 		}
 		revision, ok := change.Revisions[revisionID]
 		if !ok {
-			return "", fmt.Errorf("failed to resolve revision %s/%s", changeID, revisionID)
+			return "", "", fmt.Errorf("failed to resolve revision %s/%s", changeID, revisionID)
 		}
 
 		// fetch the version
-		if _, err := gitDir(c.dir, "fetch", cueGitSource, revision.Ref); err != nil {
-			return "", fmt.Errorf("failed to fetch %s: %v", version, err)
+		if _, err := gitDir(c.dir, "fetch", c.source, revision.Ref); err != nil {
+			return "", "", fmt.Errorf("failed to fetch %s: %v", version, err)
 		}
-		// move to FETCH_HEAD
-		if _, err := gitDir(c.dir, "switch", "-d", "FETCH_HEAD"); err != nil {
-			return "", fmt.Errorf("failed to checkout FETCH_HEAD: %v", err)
+		commit, err := c.revParse("FETCH_HEAD")
+		if err != nil {
+			return "", "", err
 		}
-		return version, nil
-	})
+		return version, commit, nil
+	}, nil
 }
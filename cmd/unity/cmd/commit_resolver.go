@@ -37,25 +37,44 @@ func newCommitResolver(c resolverConfig) (resolver, error) {
 	return res, nil
 }
 
-func (g *commitResolver) resolve(version, _, _, target string) (string, error) {
+func (g *commitResolver) resolve(version, _, working, target string) (string, error) {
+	commit, strategy, err := g.strategy(version)
+	if err != nil {
+		return "", err
+	}
+	return g.cc.resolve(commit, working, target, strategy)
+}
+
+func (g *commitResolver) goModReplace(version, _, working string) (string, error) {
+	commit, strategy, err := g.strategy(version)
+	if err != nil {
+		return "", err
+	}
+	return g.cc.sourceWorktree(commit, working, strategy)
+}
+
+func (g *commitResolver) check(version string) error {
+	_, _, err := g.strategy(version)
+	return err
+}
+
+// strategy returns the commit specified by version, and the strategy for
+// resolving it within the CUE clone.
+func (g *commitResolver) strategy(version string) (string, cueStrategy, error) {
 	if !strings.HasPrefix(version, commitVersionPrefix) {
-		return "", errNoMatch
+		return "", nil, errNoMatch
 	}
 	version = strings.TrimPrefix(version, commitVersionPrefix)
-	return g.cc.resolve(version, target, func(c *commonCUEResolver) (string, error) {
-		if _, err := gitDir(c.dir, "checkout", version); err != nil {
+	return version, func(c *commonCUEResolver) (string, string, error) {
+		if _, err := c.revParse(version); err != nil {
 			if _, err := gitDir(c.dir, "fetch", "origin"); err != nil {
-				return "", fmt.Errorf("failed to fetch origin: %v", err)
+				return "", "", fmt.Errorf("failed to fetch origin: %v", err)
 			}
 		}
-		if _, err := gitDir(c.dir, "checkout", version); err != nil {
-			return "", fmt.Errorf("failed to checkout %s: %v", version, err)
-		}
-		version, err := gitDir(c.dir, "rev-parse", "HEAD")
+		commit, err := c.revParse(version)
 		if err != nil {
-			return "", fmt.Errorf("failed to rev-parse HEAD: %v", err)
+			return "", "", err
 		}
-		version = strings.TrimSpace(version)
-		return version, nil
-	})
+		return commit, commit, nil
+	}, nil
 }
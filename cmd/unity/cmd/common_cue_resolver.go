@@ -19,6 +19,8 @@ import (
 	"os"
 	"os/exec"
 	"path/filepath"
+	"strings"
+	"sync"
 
 	"github.com/rogpeppe/go-internal/lockedfile"
 )
@@ -33,8 +35,21 @@ type commonCUEResolver struct {
 	// dir is the directory within which the CUE clone exists
 	dir string
 
+	// source is the git remote from which the CUE clone is made, and from
+	// which Gerrit refs are fetched. It defaults to cueGitSource, but can be
+	// overridden via UNITY_CUE_GIT_SOURCE, e.g. to a local bare repository in
+	// tests
+	source string
+
 	// lock controls access to the user cache dir clone of CUE
 	lock *lockedfile.Mutex
+
+	// commits records the commit that each version resolved to during this
+	// unity run, keyed by the version as passed to resolve
+	commits map[string]string
+
+	// commitsLock guards commits
+	commitsLock sync.Mutex
 }
 
 func newCommonCUEREsolver(c resolverConfig) (*commonCUEResolver, error) {
@@ -42,15 +57,33 @@ func newCommonCUEREsolver(c resolverConfig) (*commonCUEResolver, error) {
 	if err := os.MkdirAll(dir, 0777); err != nil {
 		return nil, fmt.Errorf("failed to mkdir %s: %v", dir, err)
 	}
+	source := os.Getenv("UNITY_CUE_GIT_SOURCE")
+	if source == "" {
+		source = cueGitSource
+	}
 	res := &commonCUEResolver{
-		config: c,
-		dir:    dir,
-		lock:   lockedfile.MutexAt(dir + cloneLockfile),
+		config:  c,
+		dir:     dir,
+		source:  source,
+		lock:    lockedfile.MutexAt(dir + cloneLockfile),
+		commits: make(map[string]string),
 	}
 	return res, nil
 }
 
-func (c *commonCUEResolver) resolve(version, target string, strategy func(*commonCUEResolver) (string, error)) (string, error) {
+// cueStrategy is the strategy used by a resolver that builds CUE from the
+// commonCUEResolver clone. It is called with the clone lock held, and should
+// fetch whatever is required into the clone. It returns the canonical version
+// and the commit hash that should be built for that version. A strategy must
+// not modify the clone's working tree, because builds happen concurrently in
+// separate worktrees once the lock is released.
+type cueStrategy func(*commonCUEResolver) (version, commit string, err error)
+
+// resolve resolves version via strategy, building the resulting commit in a
+// git worktree of the clone within working if there is no cache hit. Only
+// fetches into the clone and the creation of worktrees are serialised; builds
+// of different versions can happen concurrently.
+func (c *commonCUEResolver) resolve(version, working, target string, strategy cueStrategy) (string, error) {
 	// Check whether we have a cache hit
 	h := c.config.bh.cueVersionHash(version)
 	ce, _, err := c.config.bh.cache.GetFile(h.Sum())
@@ -60,28 +93,30 @@ func (c *commonCUEResolver) resolve(version, target string, strategy func(*commo
 		return version, copyExecutableFile(ce, target)
 	}
 
-	// We need to build
-	unlock, err := c.lock.Lock()
+	version, commit, err := c.fetchCommit(version, strategy)
 	if err != nil {
-		return "", fmt.Errorf("failed to acquire lockfile: %v", err)
+		return "", err
 	}
-	defer unlock()
+	h = c.config.bh.cueVersionHash(version)
 
-	// Ensure we have a clone in the first place
-	if _, err := os.Stat(filepath.Join(c.dir, ".git")); err != nil {
-		if _, err := gitDir(c.dir, "clone", cueGitSource, "."); err != nil {
-			return "", fmt.Errorf("failed to clone CUE: %v", err)
-		}
+	// The strategy might have resolved to a canonical version that we have
+	// already built, e.g. a moving ref that has not moved since
+	ce, _, err = c.config.bh.cache.GetFile(h.Sum())
+	if err == nil {
+		return version, copyExecutableFile(ce, target)
 	}
 
-	version, err = strategy(c)
-	if err != nil {
+	// Build in a worktree of our own. Note that worktree is within the
+	// temporary working directory, so if we fail to remove it here the
+	// directory is still removed, and the stale worktree metadata is pruned
+	// by a later fetch.
+	worktree := filepath.Join(working, "cue-worktree")
+	if err := c.addWorktree(worktree, commit); err != nil {
 		return "", err
 	}
-	h = c.config.bh.cueVersionHash(version)
+	defer gitDir(c.dir, "worktree", "remove", "--force", worktree)
 
-	// build
-	buildDir := filepath.Join(c.dir, "cmd", "cue")
+	buildDir := filepath.Join(worktree, "cmd", "cue")
 	cmd := exec.Command("go", "build")
 	cmd.Dir = buildDir
 	cmd.Env = append(os.Environ(), c.config.bh.buildEnv()...)
@@ -102,3 +137,92 @@ func (c *commonCUEResolver) resolve(version, target string, strategy func(*commo
 
 	return version, copyExecutableFile(buildTarget, target)
 }
+
+// sourceWorktree returns the path to a git worktree of the clone within
+// working, checked out at the commit that version resolves to. This can be
+// used as the source of cuelang.org/go, e.g. in a go.mod replace directive.
+// The strategy is only run if version was not already resolved to a commit
+// during this unity run.
+//
+// As with builds, the worktree directory is removed with working, and its
+// stale metadata is pruned by a later fetch.
+func (c *commonCUEResolver) sourceWorktree(version, working string, strategy cueStrategy) (string, error) {
+	c.commitsLock.Lock()
+	commit, ok := c.commits[version]
+	c.commitsLock.Unlock()
+	if !ok {
+		var err error
+		_, commit, err = c.fetchCommit(version, strategy)
+		if err != nil {
+			return "", err
+		}
+	}
+	worktree := filepath.Join(working, "cue-source")
+	if err := c.addWorktree(worktree, commit); err != nil {
+		return "", err
+	}
+	return worktree, nil
+}
+
+// addWorktree creates a git worktree of the clone at dir, checked out at
+// commit. The clone lock is held, because the worktree prune of a concurrent
+// fetch would otherwise remove the metadata of a worktree that is still being
+// created.
+func (c *commonCUEResolver) addWorktree(dir, commit string) error {
+	unlock, err := c.lock.Lock()
+	if err != nil {
+		return fmt.Errorf("failed to acquire lockfile: %v", err)
+	}
+	defer unlock()
+	if _, err := gitDir(c.dir, "worktree", "add", "--detach", dir, commit); err != nil {
+		return fmt.Errorf("failed to create worktree for %s: %v", commit, err)
+	}
+	return nil
+}
+
+// fetchCommit is a wrapper around fetch that records the commit that version
+// resolves to.
+func (c *commonCUEResolver) fetchCommit(version string, strategy cueStrategy) (string, string, error) {
+	canonical, commit, err := c.fetch(strategy)
+	if err != nil {
+		return "", "", err
+	}
+	c.commitsLock.Lock()
+	c.commits[version] = commit
+	c.commitsLock.Unlock()
+	return canonical, commit, nil
+}
+
+// fetch runs strategy with the clone lock held, ensuring first that the clone
+// exists and that any stale worktrees are pruned.
+func (c *commonCUEResolver) fetch(strategy cueStrategy) (version, commit string, err error) {
+	unlock, err := c.lock.Lock()
+	if err != nil {
+		return "", "", fmt.Errorf("failed to acquire lockfile: %v", err)
+	}
+	defer unlock()
+
+	// Ensure we have a clone in the first place
+	if _, err := os.Stat(filepath.Join(c.dir, ".git")); err != nil {
+		if _, err := gitDir(c.dir, "clone", c.source, "."); err != nil {
+			return "", "", fmt.Errorf("failed to clone CUE: %v", err)
+		}
+	}
+
+	// Remove the metadata of worktrees whose directories no longer exist,
+	// e.g. because a previous unity process was interrupted
+	if _, err := gitDir(c.dir, "worktree", "prune"); err != nil {
+		return "", "", fmt.Errorf("failed to prune worktrees: %v", err)
+	}
+
+	return strategy(c)
+}
+
+// revParse returns the commit hash that rev refers to in the clone.
+func (c *commonCUEResolver) revParse(rev string) (string, error) {
+	commit, err := gitDir(c.dir, "rev-parse", "--verify", rev+"^{commit}")
+	if err != nil {
+		return "", fmt.Errorf("failed to rev-parse %s: %v", rev, err)
+	}
+	return strings.TrimSpace(commit), nil
+}
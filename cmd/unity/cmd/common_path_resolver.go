@@ -112,3 +112,40 @@ func (a *commonPathResolver) buildDir(dir, target string) error {
 	}
 	return nil
 }
+
+// goModReplace returns the replacement for cuelang.org/go corresponding to
+// the version that resolve would build in dir. If cuelang.org/go is the main
+// module, then that is the module root. Otherwise, it is the module that
+// provides cuelang.org/go as a dependency, taking into account any replace
+// directive in dir.
+func (a *commonPathResolver) goModReplace(dir string) (string, error) {
+	cmd := exec.Command("go", "list", "-m", "-json", cueModule)
+	cmd.Dir = dir
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("failed to resolve module %s via [%v] in %s: %v\n%s", cueModule, cmd, dir, err, out)
+	}
+	type listModule struct {
+		Path    string
+		Version string
+		Dir     string
+		Main    bool
+	}
+	var mod struct {
+		listModule
+		Replace *listModule
+	}
+	if err := json.Unmarshal(out, &mod); err != nil {
+		return "", fmt.Errorf("failed to parse module information: %v\n%s", err, out)
+	}
+	switch {
+	case mod.Main:
+		return mod.Dir, nil
+	case mod.Replace != nil && mod.Replace.Version == "":
+		// A directory replacement
+		return mod.Replace.Dir, nil
+	case mod.Replace != nil:
+		return mod.Replace.Path + "@" + mod.Replace.Version, nil
+	}
+	return mod.Path + "@" + mod.Version, nil
+}
@@ -0,0 +1,173 @@
+// Copyright 2023 The CUE Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"os"
+	"os/exec"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+const (
+	// defaultContainerMemory is the default memory limit of the containers
+	// used in safe mode
+	defaultContainerMemory = "4g"
+
+	// defaultContainerPidsLimit is the default limit on the number of
+	// processes in the containers used in safe mode
+	defaultContainerPidsLimit = 4096
+
+	// containerPidLabel is the label of the containers created by unity,
+	// whose value is the process ID of the unity process that created the
+	// container
+	containerPidLabel = "org.cue-unity.pid"
+
+	// containerHostLabel is the label of the containers created by unity,
+	// whose value is the hostID of the unity process that created the
+	// container, such that process IDs are only compared on the same host
+	containerHostLabel = "org.cue-unity.host"
+
+	// goTestOOMMarker prefixes the line that dockexec writes to the output
+	// of go test when the container of a test binary runs out of memory,
+	// such that go test output can be reported as OOM
+	goTestOOMMarker = "unity: out of memory: "
+)
+
+// containerLimits are the resource limits and network isolation of the
+// containers that run test scripts and Go tests in safe mode.
+type containerLimits struct {
+	// network indicates that the container has network access. Otherwise
+	// it runs with --network=none.
+	network bool
+
+	// memory is the memory limit in the format of docker run --memory, or
+	// empty for no limit
+	memory string
+
+	// cpus is the number of CPUs in the format of docker run --cpus, or
+	// empty for no limit
+	cpus string
+
+	// pidsLimit is the maximum number of processes, or zero for no limit
+	pidsLimit int
+}
+
+// dockerFlags returns the docker run flags that apply l.
+func (l containerLimits) dockerFlags() []string {
+	var res []string
+	if !l.network {
+		res = append(res, "--network=none")
+	}
+	if l.memory != "" {
+		// Also limit swap, such that the limit really is a limit
+		res = append(res, "--memory="+l.memory, "--memory-swap="+l.memory)
+	}
+	if l.cpus != "" {
+		res = append(res, "--cpus="+l.cpus)
+	}
+	if l.pidsLimit > 0 {
+		res = append(res, fmt.Sprintf("--pids-limit=%d", l.pidsLimit))
+	}
+	return res
+}
+
+// containerName returns a name for a container that is unique to this
+// process, such that we can refer to the container after starting it.
+func containerName() string {
+	return fmt.Sprintf("unity-%d-%08x", os.Getpid(), rand.Uint32())
+}
+
+// containerLabelFlags returns the docker run flags that label a container as
+// created by this process, such that removeStaleContainers can remove it if
+// this process is killed before it removes the container itself.
+func containerLabelFlags() []string {
+	return []string{
+		fmt.Sprintf("--label=%s=%d", containerPidLabel, os.Getpid()),
+		fmt.Sprintf("--label=%s=%s", containerHostLabel, hostID()),
+	}
+}
+
+// hostID identifies the host, and the boot of the host, on which this process
+// runs. Process IDs are only meaningful for the same hostID, which differs
+// between the containers that share a docker daemon, as their hostnames
+// differ, as well as between machines.
+func hostID() string {
+	host, _ := os.Hostname()
+	if bootID, err := os.ReadFile("/proc/sys/kernel/random/boot_id"); err == nil {
+		host += "/" + strings.TrimSpace(string(bootID))
+	}
+	return host
+}
+
+// removeStaleContainers removes the containers created by unity processes on
+// this host that no longer exist. Such containers were leaked because the
+// unity process was killed before it could remove them. Containers created on
+// other hosts are never removed, as we cannot tell whether their unity
+// process still exists.
+func removeStaleContainers() error {
+	out, err := exec.Command("docker", "ps", "--all",
+		"--filter=label="+containerPidLabel,
+		fmt.Sprintf("--filter=label=%s=%s", containerHostLabel, hostID()),
+		fmt.Sprintf("--format={{.ID}} {{.Label %q}}", containerPidLabel),
+	).Output()
+	if err != nil {
+		return fmt.Errorf("failed to list unity containers: %v", err)
+	}
+	for _, line := range strings.Split(strings.TrimSpace(string(out)), "\n") {
+		id, pid, ok := strings.Cut(line, " ")
+		if !ok {
+			continue
+		}
+		n, err := strconv.Atoi(pid)
+		if err != nil || processExists(n) {
+			continue
+		}
+		exec.Command("docker", "rm", "--force", id).Run()
+	}
+	return nil
+}
+
+// processExists reports whether the process pid exists.
+func processExists(pid int) bool {
+	p, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+	if runtime.GOOS == "windows" {
+		// FindProcess fails for processes that do not exist
+		return true
+	}
+	return !errors.Is(p.Signal(syscall.Signal(0)), os.ErrProcessDone)
+}
+
+// containerOOMKilled reports whether the container name was killed for
+// exceeding its memory limit. The container must not have been removed yet,
+// which is why we do not use docker run --rm, and label containers via
+// containerLabelFlags instead.
+func containerOOMKilled(name string) bool {
+	out, err := exec.Command("docker", "inspect", "--format={{.State.OOMKilled}}", name).Output()
+	return err == nil && strings.TrimSpace(string(out)) == "true"
+}
+
+// removeContainer removes the container name, which has stopped.
+func removeContainer(name string) {
+	exec.Command("docker", "rm", "--force", name).Run()
+}
@@ -25,6 +25,7 @@ import (
 	"io"
 	"os"
 	"strings"
+	"time"
 
 	"cuelang.org/go/cue/errors"
 	"github.com/spf13/cobra"
@@ -103,6 +104,16 @@ func (f flagName) StringArray(cmd *Command) []string {
 	return v
 }
 
+func (f flagName) Int(cmd *Command) int {
+	v, _ := cmd.Flags().GetInt(string(f))
+	return v
+}
+
+func (f flagName) Duration(cmd *Command) time.Duration {
+	v, _ := cmd.Flags().GetDuration(string(f))
+	return v
+}
+
 var errPrintedError = errors.New("terminating because of errors")
 
 func mkRunE(c *Command, f runFunction) func(*cobra.Command, []string) error {
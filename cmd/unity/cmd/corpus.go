@@ -15,51 +15,457 @@
 package cmd
 
 import (
+	"bytes"
 	"fmt"
 	"os"
+	"path"
 	"path/filepath"
+	"sort"
 	"strings"
+	"time"
+
+	"cuelang.org/go/cue"
+	"github.com/cue-unity/unity"
+	"github.com/rogpeppe/go-internal/lockedfile"
+	"github.com/spf13/cobra"
 )
 
 func testCorpus(cmd *Command, mt *moduleTester, versions []string) error {
-	submodConfig := filepath.Join(mt.gitRoot, ".gitmodules")
-	if _, err := os.Stat(submodConfig); err != nil {
-		return fmt.Errorf("failed to find git submodules config file at %s: %v", submodConfig, err)
+	// Projects are selected by path before we derive their modules, such
+	// that we only check out the projects we test. See selectProjects.
+	globs := flagTestProject.StringArray(cmd)
+	for _, g := range globs {
+		if _, err := path.Match(g, ""); err != nil {
+			return fmt.Errorf("invalid --%s glob %q: %v", flagTestProject, g, err)
+		}
+	}
+	var modules []*module
+	var err error
+	if file := flagTestCorpusFile.String(cmd); file != "" {
+		modules, err = mt.corpusFileModules(file, globs)
+	} else {
+		modules, err = mt.submoduleModules(flagTestInit.Bool(cmd), flagTestRequireAll.Bool(cmd), globs)
+	}
+	if err != nil {
+		return err
+	}
+
+	// Module paths and tags are only known once modules are derived
+	tags := flagTestTags.String(cmd)
+	if len(globs) > 0 || tags != "" {
+		modules = filterModules(modules, globs, tags)
+		if len(modules) == 0 && len(mt.skipped) == 0 {
+			var set []string
+			if len(globs) > 0 {
+				set = append(set, "--"+string(flagTestProject))
+			}
+			if tags != "" {
+				set = append(set, "--"+string(flagTestTags))
+			}
+			return fmt.Errorf("no corpus modules match %s", strings.Join(set, " and "))
+		}
+	}
+
+	if shard := flagTestShard.String(cmd); shard != "" {
+		i, n, err := parseShard(shard)
+		if err != nil {
+			return err
+		}
+		var durations map[string]time.Duration
+		if f := flagTestShardDuration.String(cmd); f != "" {
+			durations, err = resultsDurations(f)
+			if err != nil {
+				return err
+			}
+		}
+		modules = shardModules(modules, i, n, durations)
+		if len(modules) == 0 {
+			// There are more shards than modules
+			fmt.Fprintf(os.Stderr, "shard %s has no modules to test\n", shard)
+			if mt.resultsFile != "" {
+				if err := writeResults(mt.resultsFile, nil, mt.skipped); err != nil {
+					return err
+				}
+			}
+			if mt.junitFile != "" {
+				return writeJUnit(mt.junitFile, nil, mt.skipped)
+			}
+			return nil
+		}
+	}
+
+	if len(modules) == 0 {
+		if len(mt.skipped) > 0 {
+			// Report the skipped submodules as we would alongside results
+			if mt.resultsFile != "" {
+				if err := writeResults(mt.resultsFile, nil, mt.skipped); err != nil {
+					return err
+				}
+			}
+			if mt.junitFile != "" {
+				if err := writeJUnit(mt.junitFile, nil, mt.skipped); err != nil {
+					return err
+				}
+			}
+			reportResults(nil, nil, mt.skipped, mt.verbose)
+			return fmt.Errorf("corpus empty; nothing to test as no submodules are initialised; use --%s", flagTestInit)
+		}
+		return fmt.Errorf("corpus empty; nothing to test")
 	}
 
-	submods, err := gitDir(mt.gitRoot, "config", "--file", ".gitmodules", "--get-regexp", "path")
+	return mt.test(modules, versions)
+}
+
+// matchPath reports whether the slash-separated path p, or the path of any
+// of its parent directories, matches glob.
+func matchPath(glob, p string) bool {
+	for ; p != "." && p != "/"; p = path.Dir(p) {
+		if ok, _ := path.Match(glob, p); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// selectProjects returns the corpus project paths that might contain modules
+// that match any of globs, such that other projects need not be checked out.
+// A glob that matches a project path, or the path of any of its parent
+// directories, selects that project. A glob that matches no project path can
+// only match module paths, which are not known before deriving modules, so
+// it selects every project.
+func selectProjects(globs, paths []string) []string {
+	if len(globs) == 0 {
+		return paths
+	}
+	selected := make(map[string]bool)
+	for _, g := range globs {
+		matched := false
+		for _, p := range paths {
+			if matchPath(g, p) {
+				selected[p] = true
+				matched = true
+			}
+		}
+		if !matched {
+			return paths
+		}
+	}
+	var res []string
+	for _, p := range paths {
+		if selected[p] {
+			res = append(res, p)
+		}
+	}
+	return res
+}
+
+// filterModules returns the modules that match any of globs, if there are
+// any, and whose manifests have any of the comma-separated tags, if there are
+// any. A glob matches a module if it matches the module path, or the path of
+// the module's root relative to the corpus or any of its parent directories,
+// such as the path of its project.
+func filterModules(modules []*module, globs []string, tags string) []*module {
+	want := make(map[string]bool)
+	for _, t := range strings.Split(tags, ",") {
+		if t = strings.TrimSpace(t); t != "" {
+			want[t] = true
+		}
+	}
+	matchGlob := func(m *module) bool {
+		if len(globs) == 0 {
+			return true
+		}
+		for _, g := range globs {
+			if ok, _ := path.Match(g, m.path); ok {
+				return true
+			}
+			if matchPath(g, filepath.ToSlash(m.testerRelPath)) {
+				return true
+			}
+		}
+		return false
+	}
+	matchTags := func(m *module) bool {
+		if len(want) == 0 {
+			return true
+		}
+		for _, t := range m.manifest.Tags {
+			if want[t] {
+				return true
+			}
+		}
+		return false
+	}
+	var res []*module
+	for _, m := range modules {
+		if matchGlob(m) && matchTags(m) {
+			res = append(res, m)
+		}
+	}
+	return res
+}
+
+// submoduleModules derives the modules of the corpus projects that are the git
+// submodules of mt.gitRoot that are selected by globs, as per selectProjects.
+// Submodules that are not initialised are initialised if init, are an error if
+// requireAll, and are otherwise skipped and recorded in mt.skipped.
+func (mt *moduleTester) submoduleModules(init, requireAll bool, globs []string) ([]*module, error) {
+	submods, err := submodulePaths(mt.gitRoot)
 	if err != nil {
-		return fmt.Errorf("failed to list git submodules via in %s: %v", mt.gitRoot, err)
+		return nil, err
 	}
 
 	var modules []*module
+	for _, submod := range selectProjects(globs, submods) {
+		// Check that the submodule exists locally first, using the existence of .git as that sign
+		projPath := filepath.Join(mt.gitRoot, submod)
+		if _, err := os.Stat(filepath.Join(projPath, ".git")); err != nil {
+			switch {
+			case init:
+				if _, err := gitDir(mt.gitRoot, "submodule", "update", "--init", "--", submod); err != nil {
+					return nil, fmt.Errorf("failed to initialise submodule %s: %v", submod, err)
+				}
+			case requireAll:
+				return nil, fmt.Errorf("submodule %s is not initialised; use --%s", submod, flagTestInit)
+			default:
+				fmt.Fprintf(os.Stderr, "skipping submodule %s which is not initialised\n", submod)
+				mt.skipped = append(mt.skipped, submod)
+				continue
+			}
+		}
+		ms, err := mt.deriveModules(mt.gitRoot, "", projPath)
+		if err != nil {
+			return nil, fmt.Errorf("failed to derive modules under %s: %v", projPath, err)
+		}
+		if len(ms) == 0 {
+			return nil, fmt.Errorf("could not find any CUE module roots under %s", projPath)
+		}
+		modules = append(modules, ms...)
+	}
+	return modules, nil
+}
+
+// submodulePaths returns the paths of the git submodules of gitRoot, relative
+// to gitRoot.
+func submodulePaths(gitRoot string) ([]string, error) {
+	submodConfig := filepath.Join(gitRoot, ".gitmodules")
+	if _, err := os.Stat(submodConfig); err != nil {
+		return nil, fmt.Errorf("failed to find git submodules config file at %s: %v", submodConfig, err)
+	}
+
+	submods, err := gitDir(gitRoot, "config", "--file", ".gitmodules", "--get-regexp", "path")
+	if err != nil {
+		return nil, fmt.Errorf("failed to list git submodules via in %s: %v", gitRoot, err)
+	}
 
 	// Format of submods will be one submodule per line, where the path of the submodule relative
 	// to the git root is the second field
+	var res []string
 	for _, line := range strings.Split(submods, "\n") {
 		line = strings.TrimSpace(line)
 		if line == "" {
 			continue
 		}
-		// Check that the submodule exists locally first, using the existence of .git as that sign
-		fields := strings.Fields(line)
-		projPath := filepath.Join(mt.gitRoot, fields[1])
-		if _, err := os.Stat(filepath.Join(projPath, ".git")); err != nil {
+		res = append(res, strings.Fields(line)[1])
+	}
+	return res, nil
+}
+
+// testModuleVersions tests m against each of versions, reporting a line per
+// version along with the log of any failure, and returns the versions that
+// pass.
+func (mt *moduleTester) testModuleVersions(m *module, versions []string) (passing []string) {
+	for _, v := range versions {
+		tr := &testResult{
+			log:     new(bytes.Buffer),
+			module:  m,
+			version: v,
+		}
+		if err := mt.run(tr, false); err != nil {
+			// As with unity test, log errors that are not test failures
+			// before the log of the tests
+			if !isTestFailure(err) {
+				fmt.Fprintln(os.Stderr, err)
+			}
+			fmt.Fprint(os.Stderr, tr.log.String())
+			fmt.Fprintf(os.Stderr, "FAIL %s %s\n", m.path, v)
 			continue
 		}
-		ms, err := mt.deriveModules(projPath)
-		if err != nil {
-			return fmt.Errorf("failed to derive modules under %s: %v", projPath, err)
+		passing = append(passing, v)
+		fmt.Fprintf(os.Stderr, "ok   %s %s\n", m.path, v)
+	}
+	return passing
+}
+
+// corpusFileModules derives the modules of the corpus projects declared in
+// the CUE corpus file, which must satisfy #Corpus, that are selected by globs,
+// as per selectProjects. Each project is checked out at its pinned commit
+// within the temporary working directory, which is the root relative to which
+// its modules are named. As updates to the scripts
+// of such a checkout would be lost, --update is only allowed when the scripts
+// of every module come from overlays.
+func (mt *moduleTester) corpusFileModules(file string, globs []string) ([]*module, error) {
+	file, err := filepath.Abs(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to make path %s absolute: %v", file, err)
+	}
+	src, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read corpus file: %v", err)
+	}
+	corpusInput := mt.runtime.CompileBytes(src, cue.Filename(file))
+	if err := corpusInput.Err(); err != nil {
+		return nil, fmt.Errorf("failed to load corpus file %s: %v", file, err)
+	}
+	corpusDef := loadSchema(mt.runtime, "Corpus")
+	if err := corpusDef.Err(); err != nil {
+		return nil, fmt.Errorf("failed to load #Corpus definition: %v", err)
+	}
+	corpusVal := corpusDef.Unify(corpusInput)
+	if err := corpusVal.Validate(cue.Concrete(true)); err != nil {
+		return nil, fmt.Errorf("failed to validate corpus file: %v", err)
+	}
+	var corpus unity.Corpus
+	if err := corpusVal.Decode(&corpus); err != nil {
+		return nil, fmt.Errorf("failed to decode corpus file: %v", err)
+	}
+
+	var names []string
+	for name := range corpus.Projects {
+		if path.IsAbs(name) || path.Clean(name) != name || name == ".." || strings.HasPrefix(name, "../") {
+			return nil, fmt.Errorf("invalid corpus project path %q", name)
 		}
-		if len(ms) == 0 {
-			return fmt.Errorf("could not find any CUE module roots under %s", projPath)
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	names = selectProjects(globs, names)
+
+	testerRoot := filepath.Join(mt.working, "corpus")
+	var modules []*module
+	for _, name := range names {
+		p := corpus.Projects[name]
+		if strings.HasPrefix(p.Repo, "./") || strings.HasPrefix(p.Repo, "../") {
+			p.Repo = filepath.Join(filepath.Dir(file), filepath.FromSlash(p.Repo))
+		}
+		projPath := filepath.Join(testerRoot, filepath.FromSlash(name))
+		if err := mt.checkoutCorpusProject(p, projPath); err != nil {
+			return nil, fmt.Errorf("failed to check out corpus project %s: %v", name, err)
+		}
+		var overlay string
+		if p.Overlay != "" {
+			overlay = filepath.Join(filepath.Dir(file), filepath.FromSlash(p.Overlay))
+			if fi, err := os.Stat(overlay); err != nil || !fi.IsDir() {
+				return nil, fmt.Errorf("failed to find overlay directory %s of corpus project %s", overlay, name)
+			}
+		}
+		var ms []*module
+		if len(p.Modules) == 0 {
+			ms, err = mt.deriveModules(testerRoot, overlay, projPath)
+			if err != nil {
+				return nil, fmt.Errorf("failed to derive modules of corpus project %s: %v", name, err)
+			}
+			if len(ms) == 0 {
+				return nil, fmt.Errorf("could not find any CUE module roots in corpus project %s", name)
+			}
+		}
+		for _, mp := range p.Modules {
+			modDir := filepath.Join(projPath, filepath.FromSlash(mp))
+			if fi, err := os.Stat(filepath.Join(modDir, "cue.mod")); err != nil || !fi.IsDir() {
+				return nil, fmt.Errorf("could not find CUE module root %s in corpus project %s", mp, name)
+			}
+			m, err := mt.newInstance(testerRoot, overlay, projPath, modDir)
+			if err != nil {
+				return nil, fmt.Errorf("failed to create module instance for %s in corpus project %s: %v", mp, name, err)
+			}
+			ms = append(ms, m)
+		}
+		if mt.update {
+			for _, m := range ms {
+				if s := m.checkoutScript(projPath); s != "" {
+					return nil, fmt.Errorf("cannot use --%s with --%s: script %s of %s in corpus project %s is not in an overlay", flagTestUpdate, flagTestCorpusFile, filepath.Base(s), m.path, name)
+				}
+			}
 		}
 		modules = append(modules, ms...)
 	}
+	return modules, nil
+}
 
-	if len(modules) == 0 {
-		return fmt.Errorf("corpus empty; nothing to test")
+// checkoutScript returns the source of any of the scripts of m that is within
+// the checkout dir, or the empty string if all come from overlays.
+func (m *module) checkoutScript(dir string) string {
+	for _, s := range m.scripts {
+		if src, ok := m.scriptSources[s]; ok {
+			s = src
+		}
+		if rel, err := filepath.Rel(dir, s); err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			return s
+		}
 	}
+	return ""
+}
 
-	return mt.test(modules, versions)
+// checkoutCorpusProject checks out the pinned commit of the corpus project p
+// at dir. Projects are fetched into bare clones within the user cache dir,
+// such that dir is a cheap clone that shares their objects.
+func (mt *moduleTester) checkoutCorpusProject(p unity.CorpusProject, dir string) error {
+	clone := mt.buildHelper.corpusCloneDir(p.Repo)
+	if err := os.MkdirAll(filepath.Dir(clone), 0777); err != nil {
+		return fmt.Errorf("failed to mkdir %s: %v", filepath.Dir(clone), err)
+	}
+	unlock, err := lockedfile.MutexAt(clone + cloneLockfile).Lock()
+	if err != nil {
+		return fmt.Errorf("failed to acquire lockfile: %v", err)
+	}
+	defer unlock()
+
+	if _, err := os.Stat(clone); err != nil {
+		if _, err := gitDir(filepath.Dir(clone), "clone", "--mirror", p.Repo, clone); err != nil {
+			os.RemoveAll(clone)
+			return fmt.Errorf("failed to clone %s: %v", p.Repo, err)
+		}
+	}
+	hasCommit := func() bool {
+		_, err := gitDir(clone, "cat-file", "-e", p.Commit+"^{commit}")
+		return err == nil
+	}
+	if !hasCommit() {
+		if _, err := gitDir(clone, "fetch", "origin"); err != nil {
+			return fmt.Errorf("failed to fetch %s: %v", p.Repo, err)
+		}
+	}
+	if !hasCommit() {
+		// The commit is not reachable from any ref, so try to fetch it
+		// directly, which not all servers allow. Keep a ref to it such that
+		// it is not garbage collected.
+		if _, err := gitDir(clone, "fetch", "origin", p.Commit); err != nil {
+			return fmt.Errorf("failed to fetch commit %s from %s: %v", p.Commit, p.Repo, err)
+		}
+		if _, err := gitDir(clone, "update-ref", "refs/unity/"+p.Commit, p.Commit); err != nil {
+			return fmt.Errorf("failed to create ref for %s: %v", p.Commit, err)
+		}
+	}
+
+	if err := os.MkdirAll(filepath.Dir(dir), 0777); err != nil {
+		return fmt.Errorf("failed to mkdir %s: %v", filepath.Dir(dir), err)
+	}
+	if _, err := gitDir(filepath.Dir(dir), "clone", "--quiet", "--shared", "--no-checkout", clone, dir); err != nil {
+		return fmt.Errorf("failed to clone %s: %v", clone, err)
+	}
+	if _, err := gitDir(dir, "checkout", "--quiet", "--detach", p.Commit); err != nil {
+		return fmt.Errorf("failed to check out %s: %v", p.Commit, err)
+	}
+	return nil
+}
+
+// newCorpusCmd creates the corpus command, the parent of the commands that
+// maintain a corpus
+func newCorpusCmd(c *Command) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "corpus",
+		Short: "maintain a corpus of projects",
+	}
+	cmd.AddCommand(newCorpusAddCmd(c))
+	cmd.AddCommand(newCorpusUpdateCmd(c))
+	return cmd
 }
@@ -0,0 +1,257 @@
+// Copyright 2023 The CUE Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"cuelang.org/go/cue/format"
+	"github.com/spf13/cobra"
+)
+
+const (
+	flagCorpusAddPath flagName = "path"
+)
+
+const (
+	// corpusProjectsDir is the directory of a corpus within which projects
+	// are added by unity corpus add
+	corpusProjectsDir = "projects"
+
+	// manifestFile is the name of the file that holds a tests manifest
+	// scaffolded by unity
+	manifestFile = "tests.cue"
+
+	// smokeScriptFile is the name of the test script scaffolded by unity
+	// corpus add for modules that have none
+	smokeScriptFile = "vet.txt"
+)
+
+// smokeScript is the test script scaffolded by unity corpus add for modules
+// that have none. It only checks that the module is valid.
+const smokeScript = `# Smoke test scaffolded by unity corpus add. Replace or extend it with tests
+# that exercise the module.
+cue vet ./...
+`
+
+// newCorpusAddCmd creates the corpus add command
+func newCorpusAddCmd(c *Command) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "add <repo> [versions...]",
+		Short: "add a project to the corpus as a git submodule",
+		Long: `
+add adds the git repository repo to the corpus that contains the working
+directory as a git submodule, by default at projects/$host/$path. The CUE
+modules of the project are found in the same way as unity test.
+
+A module that does not have a tests manifest of its own is given an overlay in
+the last --overlay directory, made up of a manifest and a smoke test script that
+runs cue vet. The manifest's Versions are those of the versions that pass the
+tests, which are go.mod if none are given as arguments.
+`,
+		RunE: mkRunE(c, corpusAddDef),
+	}
+	cmd.Flags().String(string(flagCorpusAddPath), "", "the path of the submodule, relative to the root of the corpus")
+	cmd.Flags().StringP(string(flagTestDir), "d", ".", "a directory within the corpus")
+	cmd.Flags().StringArray(string(flagTestOverlay), nil, "a directory, or list of directories, from which to source overlays; overlays are scaffolded in the last")
+	addTesterFlags(cmd)
+	return cmd
+}
+
+func corpusAddDef(c *Command, args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("missing repository to add")
+	}
+	repo, versions := args[0], args[1:]
+	if len(versions) == 0 {
+		versions = []string{"go.mod"}
+	}
+
+	mt, cleanup, err := newTesterFromFlags(c)
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+
+	projPath := flagCorpusAddPath.String(c)
+	if projPath == "" {
+		projPath = corpusProjectPath(repo)
+	}
+	if _, err := gitDir(mt.gitRoot, "submodule", "add", repo, projPath); err != nil {
+		return fmt.Errorf("failed to add submodule: %v", err)
+	}
+	projDir := filepath.Join(mt.gitRoot, filepath.FromSlash(projPath))
+
+	// Only keep the submodule if we can scaffold what its modules need
+	roots, err := mt.overlayRoots(projDir)
+	if err != nil {
+		if rerr := removeSubmodule(mt.gitRoot, projPath); rerr != nil {
+			return fmt.Errorf("%v; failed to remove submodule %s: %v", err, projPath, rerr)
+		}
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "added %s at %s\n", repo, projPath)
+
+	var failed []string
+	for _, root := range roots {
+		rel, err := filepath.Rel(mt.gitRoot, root)
+		if err != nil {
+			return err
+		}
+		overlay := filepath.Join(mt.overlayDirs[len(mt.overlayDirs)-1], rel)
+		passing, err := mt.scaffoldOverlay(projDir, root, overlay, versions)
+		if err != nil {
+			return err
+		}
+		if len(passing) == 0 {
+			failed = append(failed, rel)
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("no versions passed for %s; specify versions to try as arguments, or fix the scaffolded overlays", strings.Join(failed, ", "))
+	}
+	return nil
+}
+
+// overlayRoots returns the roots of the CUE modules of the project at projDir
+// that need an overlay to be scaffolded, which is an error if there are no
+// overlay directories.
+func (mt *moduleTester) overlayRoots(projDir string) ([]string, error) {
+	projPath, err := filepath.Rel(mt.gitRoot, projDir)
+	if err != nil {
+		return nil, err
+	}
+	roots, err := findModuleRoots(projDir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to find CUE modules in %s: %v", projPath, err)
+	}
+	if len(roots) == 0 {
+		return nil, fmt.Errorf("could not find any CUE module roots under %s", projPath)
+	}
+	var res []string
+	for _, root := range roots {
+		rel, err := filepath.Rel(mt.gitRoot, root)
+		if err != nil {
+			return nil, err
+		}
+		if fi, err := os.Stat(filepath.Join(root, "cue.mod", packageTests)); err == nil && fi.IsDir() {
+			fmt.Fprintf(os.Stderr, "%s has its own tests manifest\n", rel)
+			continue
+		}
+		if len(mt.overlayDirs) == 0 {
+			return nil, fmt.Errorf("%s does not have a tests manifest; use --%s to scaffold an overlay", rel, flagTestOverlay)
+		}
+		if existing := mt.overlaysOf(rel); len(existing) > 0 {
+			fmt.Fprintf(os.Stderr, "%s already has an overlay at %s\n", rel, existing[len(existing)-1])
+			continue
+		}
+		res = append(res, root)
+	}
+	return res, nil
+}
+
+// removeSubmodule undoes the git submodule add of the submodule at projPath,
+// relative to gitRoot, such that it can be added again.
+func removeSubmodule(gitRoot, projPath string) error {
+	if _, err := gitDir(gitRoot, "rm", "--quiet", "--force", "--", projPath); err != nil {
+		return err
+	}
+	gitCommonDir, err := gitDir(gitRoot, "rev-parse", "--git-common-dir")
+	if err != nil {
+		return err
+	}
+	modules := filepath.Join(strings.TrimSpace(gitCommonDir), "modules", filepath.FromSlash(projPath))
+	if !filepath.IsAbs(modules) {
+		modules = filepath.Join(gitRoot, modules)
+	}
+	return os.RemoveAll(modules)
+}
+
+// scaffoldOverlay creates an overlay at overlay for the module at root within
+// the project at projDir, with a smoke test script and a manifest that lists
+// the versions that pass. The module is tested against each of versions.
+func (mt *moduleTester) scaffoldOverlay(projDir, root, overlay string, versions []string) (passing []string, err error) {
+	if err := os.MkdirAll(overlay, 0777); err != nil {
+		return nil, fmt.Errorf("failed to create overlay directory: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(overlay, smokeScriptFile), []byte(smokeScript), 0666); err != nil {
+		return nil, fmt.Errorf("failed to write smoke test script: %v", err)
+	}
+	// Start with no versions, such that we can load the module to test it
+	if err := writeManifest(overlay, nil); err != nil {
+		return nil, err
+	}
+	m, err := mt.newInstance(mt.gitRoot, "", projDir, root)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create module instance at %s: %v", root, err)
+	}
+	passing = mt.testModuleVersions(m, versions)
+	if err := writeManifest(overlay, passing); err != nil {
+		return nil, err
+	}
+	fmt.Fprintf(os.Stderr, "scaffolded overlay %s\n", overlay)
+	return passing, nil
+}
+
+// writeManifest writes a tests manifest with the given Versions to dir.
+func writeManifest(dir string, versions []string) error {
+	if versions == nil {
+		versions = []string{}
+	}
+	vs, err := json.Marshal(versions)
+	if err != nil {
+		return err
+	}
+	src, err := format.Source([]byte(fmt.Sprintf("package %s\n\nVersions: %s\n", packageTests, vs)))
+	if err != nil {
+		return fmt.Errorf("failed to format manifest: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, manifestFile), src, 0666); err != nil {
+		return fmt.Errorf("failed to write manifest: %v", err)
+	}
+	return nil
+}
+
+// corpusProjectPath derives the path of a corpus project from the URL of its
+// repository, following the layout of the unity corpus. For example,
+// https://github.com/cue-unity/example.git is added at
+// projects/github.com/cue-unity/example. Local repositories are added at their
+// base name within projects.
+func corpusProjectPath(repo string) string {
+	p := strings.TrimSuffix(strings.TrimSuffix(repo, "/"), ".git")
+	if i := strings.Index(p, "://"); i >= 0 {
+		scheme := p[:i]
+		p = p[i+len("://"):]
+		if scheme == "file" {
+			p = path.Base(p)
+		} else if j := strings.Index(p, "@"); j >= 0 && j < strings.Index(p+"/", "/") {
+			p = p[j+1:]
+		}
+	} else if i := strings.Index(p, ":"); i >= 0 && !strings.Contains(p[:i], "/") && !filepath.IsAbs(p) {
+		// scp-like syntax, e.g. git@github.com:cue-unity/example
+		p = p[:i] + "/" + p[i+1:]
+		if j := strings.Index(p, "@"); j >= 0 && j < i {
+			p = p[j+1:]
+		}
+	} else {
+		p = filepath.Base(p)
+	}
+	return path.Join(corpusProjectsDir, p)
+}
@@ -0,0 +1,195 @@
+// Copyright 2023 The CUE Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/spf13/cobra"
+)
+
+// The outcomes of updating a corpus project via unity corpus update
+const (
+	updateUpToDate     = "up to date"
+	updateBumped       = "bumped"
+	updateHeldBack     = "held back"
+	updateNewlyFailing = "newly failing"
+)
+
+// newCorpusUpdateCmd creates the corpus update command
+func newCorpusUpdateCmd(c *Command) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "update [projects...]",
+		Short: "update corpus submodules whose tests pass",
+		Long: `
+update fetches the upstream default branch of each of the git submodules of the
+corpus that contains the working directory, or of the given projects, which
+are paths of submodules relative to the root of the corpus. The new commit of
+a project is tested against the base versions of the manifests of its modules.
+
+If the tests pass, the submodule is checked out at the new commit, and the
+change is staged. Otherwise the submodule is left at its current commit, and
+the project is reported as held back if the tests of the current commit also
+fail, or as newly failing if they pass. update fails if any project is newly
+failing.
+`,
+		RunE: mkRunE(c, corpusUpdateDef),
+	}
+	cmd.Flags().StringP(string(flagTestDir), "d", ".", "a directory within the corpus")
+	cmd.Flags().StringArray(string(flagTestOverlay), nil, "a directory, or list of directories, from which to source overlays; may be repeated, with later directories taking precedence")
+	addTesterFlags(cmd)
+	return cmd
+}
+
+func corpusUpdateDef(c *Command, args []string) error {
+	mt, cleanup, err := newTesterFromFlags(c)
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+
+	submods, err := submodulePaths(mt.gitRoot)
+	if err != nil {
+		return err
+	}
+	projects := submods
+	if len(args) > 0 {
+		known := make(map[string]bool)
+		for _, s := range submods {
+			known[s] = true
+		}
+		projects = nil
+		for _, a := range args {
+			p := filepath.ToSlash(filepath.Clean(a))
+			if !known[p] {
+				return fmt.Errorf("%s is not a submodule of %s", a, mt.gitRoot)
+			}
+			projects = append(projects, p)
+		}
+	}
+
+	type update struct {
+		project  string
+		outcome  string
+		from, to string
+	}
+	var updates []update
+	sawNewlyFailing := false
+	for _, p := range projects {
+		from, to, outcome, err := mt.updateSubmodule(p)
+		if err != nil {
+			return fmt.Errorf("failed to update %s: %v", p, err)
+		}
+		sawNewlyFailing = sawNewlyFailing || outcome == updateNewlyFailing
+		updates = append(updates, update{project: p, outcome: outcome, from: from, to: to})
+	}
+
+	for _, u := range updates {
+		line := fmt.Sprintf("%-13s  %s", u.outcome, u.project)
+		if u.outcome != updateUpToDate {
+			line += fmt.Sprintf("  %.12s..%.12s", u.from, u.to)
+		}
+		fmt.Println(line)
+	}
+	if sawNewlyFailing {
+		exit()
+	}
+	return nil
+}
+
+// updateSubmodule fetches the upstream default branch of the submodule at
+// path p, relative to mt.gitRoot, and checks it out if the tests of the
+// new commit pass. It returns the current and new commits along with the
+// outcome.
+func (mt *moduleTester) updateSubmodule(p string) (from, to, outcome string, err error) {
+	dir := filepath.Join(mt.gitRoot, filepath.FromSlash(p))
+	if _, err := os.Stat(filepath.Join(dir, ".git")); err != nil {
+		return "", "", "", fmt.Errorf("submodule is not initialised")
+	}
+	// We check out other commits in the submodule, so it must be clean
+	if _, err := mt.verifyGitStatus(dir); err != nil {
+		return "", "", "", err
+	}
+	from, err = gitDir(dir, "rev-parse", "HEAD")
+	if err != nil {
+		return "", "", "", err
+	}
+	from = strings.TrimSpace(from)
+
+	// The remote HEAD is the tip of the default branch
+	if _, err := gitDir(dir, "fetch", "origin", "HEAD"); err != nil {
+		return "", "", "", err
+	}
+	to, err = gitDir(dir, "rev-parse", "FETCH_HEAD")
+	if err != nil {
+		return "", "", "", err
+	}
+	to = strings.TrimSpace(to)
+	if to == from {
+		return from, to, updateUpToDate, nil
+	}
+
+	fmt.Fprintf(os.Stderr, "testing %s at %s\n", p, to)
+	pass, err := mt.testSubmoduleAt(dir, to)
+	if err != nil {
+		return "", "", "", err
+	}
+	if pass {
+		if _, err := gitDir(mt.gitRoot, "add", p); err != nil {
+			return "", "", "", err
+		}
+		return from, to, updateBumped, nil
+	}
+
+	fmt.Fprintf(os.Stderr, "testing %s at %s\n", p, from)
+	pass, err = mt.testSubmoduleAt(dir, from)
+	if err != nil {
+		return "", "", "", err
+	}
+	if pass {
+		return from, to, updateNewlyFailing, nil
+	}
+	return from, to, updateHeldBack, nil
+}
+
+// testSubmoduleAt checks out commit in the submodule dir, and reports whether
+// its modules pass the tests of their base versions.
+func (mt *moduleTester) testSubmoduleAt(dir, commit string) (bool, error) {
+	if _, err := gitDir(dir, "checkout", "--quiet", "--detach", commit); err != nil {
+		return false, err
+	}
+	modules, err := mt.deriveModules(mt.gitRoot, "", dir)
+	if err != nil {
+		// A module that cannot be loaded, e.g. because its manifest is no
+		// longer valid, fails its tests
+		fmt.Fprintln(os.Stderr, err)
+		return false, nil
+	}
+	if len(modules) == 0 {
+		fmt.Fprintf(os.Stderr, "could not find any CUE module roots under %s\n", dir)
+		return false, nil
+	}
+	pass := true
+	for _, m := range modules {
+		versions := m.manifest.Versions
+		if len(mt.testModuleVersions(m, versions)) != len(versions) {
+			pass = false
+		}
+	}
+	return pass, nil
+}
@@ -0,0 +1,131 @@
+// Copyright 2023 The CUE Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"debug/buildinfo"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"strings"
+)
+
+// cueBuildInfo is the version information embedded in a resolved cue binary
+// by the Go toolchain, as reported by `go version -m`. Any field might be
+// empty, because older versions of Go record less information.
+type cueBuildInfo struct {
+	// Version is the version of the cuelang.org/go module, e.g. v0.5.0 or
+	// (devel) when built from a checkout of CUE
+	Version string
+
+	// Revision is the VCS revision from which cue was built
+	Revision string
+
+	// Modified indicates that the VCS checkout had uncommitted changes
+	Modified bool
+
+	// GoVersion is the version of Go used to build cue
+	GoVersion string
+
+	// GOOS and GOARCH are the target platform for which cue was built
+	GOOS   string
+	GOARCH string
+}
+
+// probeCUE reads the build information from the cue binary at path, and
+// checks that the binary was built for the GOOS and GOARCH targeted by bh. It
+// is not an error for path to not be a Go binary, or to not contain build
+// information, in which case a nil *cueBuildInfo is returned.
+func (bh *buildHelper) probeCUE(path string) (*cueBuildInfo, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open cue binary: %v", err)
+	}
+	defer f.Close()
+	bi, err := buildinfo.Read(f)
+	if err != nil {
+		// Having opened the file, any error is because f is not a Go
+		// binary or has no build information, unless we failed to read it
+		var pathErr *fs.PathError
+		if errors.As(err, &pathErr) {
+			return nil, fmt.Errorf("failed to read build information from %s: %v", path, err)
+		}
+		return nil, nil
+	}
+	res := &cueBuildInfo{
+		GoVersion: bi.GoVersion,
+	}
+	if bi.Main.Path == cueModule {
+		res.Version = bi.Main.Version
+	}
+	for _, d := range bi.Deps {
+		if d.Path != cueModule {
+			continue
+		}
+		res.Version = d.Version
+		if d.Replace != nil {
+			res.Version = d.Replace.Version
+			if res.Version == "" {
+				res.Version = d.Replace.Path
+			}
+		}
+	}
+	for _, s := range bi.Settings {
+		switch s.Key {
+		case "vcs.revision":
+			res.Revision = s.Value
+		case "vcs.modified":
+			res.Modified = s.Value == "true"
+		case "GOOS":
+			res.GOOS = s.Value
+		case "GOARCH":
+			res.GOARCH = s.Value
+		}
+	}
+	if res.GOOS != "" && res.GOARCH != "" && (res.GOOS != bh.targetGOOS || res.GOARCH != bh.targetGOARCH) {
+		return nil, fmt.Errorf("cue binary %s was built for %s/%s; target is %s/%s", path, res.GOOS, res.GOARCH, bh.targetGOOS, bh.targetGOARCH)
+	}
+	return res, nil
+}
+
+// String returns a short summary of b for use in logs and result tables.
+func (b *cueBuildInfo) String() string {
+	if b == nil {
+		return "unknown"
+	}
+	version := b.Version
+	if version == "" {
+		version = "unknown"
+	}
+	var details []string
+	if b.Revision != "" {
+		rev := b.Revision
+		if len(rev) > 12 {
+			rev = rev[:12]
+		}
+		if b.Modified {
+			rev += "+dirty"
+		}
+		details = append(details, "rev "+rev)
+	}
+	if b.GoVersion != "" {
+		details = append(details, b.GoVersion)
+	}
+	if len(details) == 0 {
+		return version
+	}
+	return fmt.Sprintf("%s (%s)", version, strings.Join(details, ", "))
+}
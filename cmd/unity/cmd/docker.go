@@ -15,59 +15,197 @@
 package cmd
 
 import (
+	"encoding/json"
+	"fmt"
 	"os"
+	"path"
+	"path/filepath"
+	"time"
 
+	"cuelang.org/go/cue/errors"
+	"github.com/cue-unity/unity"
 	"github.com/spf13/cobra"
 )
 
-// TODO(mvdan): consider a single file with all the encoded data, like JSON,
-// which should mean less code and the ability to pass maps/slices easily.
-// That is with the assumption that noone would run `unity docker` manually.
 const (
-	flagDockerSelf          flagName = "self"
-	flagDockerManifest      flagName = "manifest"
-	flagDockerWorkdirRoot   flagName = "workdirRoot"
-	flagDockerRelPath       flagName = "relPath"
-	flagDockerTesterRelPath flagName = "testerRelPath"
-	flagDockerCUEPath       flagName = "cuePath"
-	flagDockerVersion       flagName = "version"
-	flagDockerUpdate        flagName = "update"
-	flagDockerVerbose       flagName = "verbose"
+	flagDockerSpec flagName = "spec"
 )
 
-// newTestCmd creates a new test command
-//
-// TODO: update the command's long description
+const (
+	// runSpecVersion is the version of the runSpec format. It must be
+	// incremented whenever the meaning of an existing field changes.
+	runSpecVersion = 1
+
+	// runSpecFile is the name of the file in the workdir root to which we
+	// write the runSpec for unity docker
+	runSpecFile = ".unity-run-spec.json"
+
+	// scriptResultsFile is the name of the file in the workdir root to which
+	// unity docker writes the results of the scripts it ran, as opposed to
+	// its log, which it writes to stdout
+	scriptResultsFile = ".unity-script-results.json"
+)
+
+// exitCodeTimeout is the exit code of unity docker when tests time out, such
+// that dockerRunModule can tell a timeout apart from a failure.
+const exitCodeTimeout = 3
+
+// errDockerTimeout is the error with which unity docker exits with
+// exitCodeTimeout.
+var errDockerTimeout = errors.New("tests timed out")
+
+// runSpec is the encoding of runModuleInfo that we pass to unity docker via
+// a file in the workdir root. Paths are those at which unity docker sees the
+// files, which need not be the same as on the host.
+type runSpec struct {
+	// SpecVersion is the runSpecVersion of the unity that wrote the spec
+	SpecVersion int
+
+	Self          string
+	ManifestDir   string
+	WorkdirRoot   string
+	RelPath       string
+	TesterRelPath string
+	CUEPath       string
+	Version       string
+
+	// Env are the NAME=value environment settings for cue invocations
+	Env []string
+
+	GoTests map[string]unity.GoTestFlags
+
+	Parallel       int
+	ScriptTimeout  time.Duration
+	Timeout        time.Duration
+	ScriptTimeouts map[string]time.Duration
+	Update         bool
+	Verbose        bool
+}
+
+// newRunSpec returns the runSpec that corresponds to info.
+func newRunSpec(info runModuleInfo) runSpec {
+	return runSpec{
+		SpecVersion:    runSpecVersion,
+		Self:           info.self,
+		ManifestDir:    info.manifestDir,
+		WorkdirRoot:    info.workdirRoot,
+		RelPath:        info.relPath,
+		TesterRelPath:  info.testerRelPath,
+		CUEPath:        info.cuePath,
+		Version:        info.version,
+		Env:            info.env,
+		GoTests:        info.goTests,
+		Parallel:       info.parallel,
+		ScriptTimeout:  info.scriptTimeout,
+		Timeout:        info.timeout,
+		ScriptTimeouts: info.scriptTimeouts,
+		Update:         info.update,
+		Verbose:        info.verbose,
+	}
+}
+
+// info returns the runModuleInfo that corresponds to s.
+func (s runSpec) info() runModuleInfo {
+	return runModuleInfo{
+		self:           s.Self,
+		manifestDir:    s.ManifestDir,
+		workdirRoot:    s.WorkdirRoot,
+		relPath:        s.RelPath,
+		testerRelPath:  s.TesterRelPath,
+		cuePath:        s.CUEPath,
+		version:        s.Version,
+		env:            s.Env,
+		goTests:        s.GoTests,
+		parallel:       s.Parallel,
+		scriptTimeout:  s.ScriptTimeout,
+		timeout:        s.Timeout,
+		scriptTimeouts: s.ScriptTimeouts,
+		update:         s.Update,
+		verbose:        s.Verbose,
+	}
+}
+
+// unityDockerArgs writes the runSpec for info to its workdir root, and returns
+// the command line of unity docker given the paths at which self, the
+// manifest directory, the workdir root and the cue binary are available to
+// it.
+func unityDockerArgs(info runModuleInfo, self, manifestDir, workdirRoot, cuePath string) ([]string, error) {
+	spec := newRunSpec(info)
+	spec.Self = self
+	spec.ManifestDir = manifestDir
+	spec.WorkdirRoot = workdirRoot
+	spec.CUEPath = cuePath
+	data, err := json.MarshalIndent(spec, "", "\t")
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode run spec: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(info.workdirRoot, runSpecFile), data, 0666); err != nil {
+		return nil, fmt.Errorf("failed to write run spec: %v", err)
+	}
+	// unity docker always runs on Linux, hence path as opposed to filepath
+	return []string{self, "docker", "--" + string(flagDockerSpec), path.Join(workdirRoot, runSpecFile)}, nil
+}
+
+// newDockerCmd creates a new docker command, which runs the test scripts
+// described by a runSpec. It is run by unity test within a sandbox.
 func newDockerCmd(c *Command) *cobra.Command {
 	cmd := &cobra.Command{
 		Use:    "docker",
 		Hidden: true,
 		RunE:   mkRunE(c, dockerDef),
 	}
-	cmd.Flags().String(string(flagDockerSelf), "", "the path to self")
-	cmd.Flags().String(string(flagDockerManifest), "", "the path to the manifest directory for the project")
-	cmd.Flags().String(string(flagDockerWorkdirRoot), "", "the workdir root for the project under test")
-	cmd.Flags().String(string(flagDockerRelPath), "", "the relative path to the project git root")
-	cmd.Flags().String(string(flagDockerTesterRelPath), "", "the relative path the module tester git root")
-	cmd.Flags().String(string(flagDockerCUEPath), "", "the path to the CUE binary to use")
-	cmd.Flags().String(string(flagDockerVersion), "", "the version being tested")
-	cmd.Flags().Bool(string(flagDockerUpdate), false, "update test archives when cmp fails")
-	cmd.Flags().Bool(string(flagDockerVerbose), false, "run in verbose mode")
+	cmd.Flags().String(string(flagDockerSpec), "", "the path to the JSON run spec")
 	return cmd
 }
 
 func dockerDef(c *Command, args []string) error {
-	return runModule(os.Stdout,
-		runModuleInfo{
-			self:          flagDockerSelf.String(c),
-			manifestDir:   flagDockerManifest.String(c),
-			workdirRoot:   flagDockerWorkdirRoot.String(c),
-			relPath:       flagDockerRelPath.String(c),
-			testerRelPath: flagDockerTesterRelPath.String(c),
-			cuePath:       flagDockerCUEPath.String(c),
-			version:       flagDockerVersion.String(c),
-			update:        flagDockerUpdate.Bool(c),
-			verbose:       flagDockerVerbose.Bool(c),
-		},
-	)
+	data, err := os.ReadFile(flagDockerSpec.String(c))
+	if err != nil {
+		return fmt.Errorf("failed to read run spec: %v", err)
+	}
+	var spec runSpec
+	if err := json.Unmarshal(data, &spec); err != nil {
+		return fmt.Errorf("failed to decode run spec: %v", err)
+	}
+	if spec.SpecVersion != runSpecVersion {
+		return fmt.Errorf("unsupported run spec version %d; want %d", spec.SpecVersion, runSpecVersion)
+	}
+	scripts, err := runModule(os.Stdout, spec.info())
+	if err := writeScriptResults(filepath.Join(spec.WorkdirRoot, scriptResultsFile), scripts); err != nil {
+		return err
+	}
+	if errors.Is(err, errTestTimeout) {
+		// Exit with exitCodeTimeout, having already logged the details
+		panic(panicError{errDockerTimeout})
+	}
+	return err
+}
+
+// writeScriptResults writes the results of scripts to the file path.
+func writeScriptResults(path string, scripts []scriptResult) error {
+	data, err := json.MarshalIndent(encodeScripts(scripts), "", "\t")
+	if err != nil {
+		return fmt.Errorf("failed to encode script results: %v", err)
+	}
+	if err := os.WriteFile(path, data, 0666); err != nil {
+		return fmt.Errorf("failed to write script results: %v", err)
+	}
+	return nil
+}
+
+// readScriptResults reads the results of the scripts that unity docker ran
+// for the workdir root dir. There are none if unity docker did not get as far
+// as writing them.
+func readScriptResults(dir string) ([]scriptResult, error) {
+	data, err := os.ReadFile(filepath.Join(dir, scriptResultsFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to read script results: %v", err)
+	}
+	var scripts []scriptJSON
+	if err := json.Unmarshal(data, &scripts); err != nil {
+		return nil, fmt.Errorf("failed to decode script results: %v", err)
+	}
+	return decodeScripts(scripts), nil
 }
@@ -0,0 +1,81 @@
+// Copyright 2023 The CUE Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/cue-unity/unity"
+)
+
+func TestRunSpecRoundTrip(t *testing.T) {
+	info := runModuleInfo{
+		self:          "/unity",
+		manifestDir:   "/start/cue.mod/tests",
+		workdirRoot:   "/workdir",
+		relPath:       "sub",
+		testerRelPath: "projects/mod",
+		cuePath:       "/cue/cue",
+		version:       "v0.6.0",
+		env:           []string{"CUE_EXPERIMENT=evalv3", "X=a b"},
+		goTests: map[string]unity.GoTestFlags{
+			"./...": {
+				Run:     []string{"TestA"},
+				Skip:    []string{"TestB"},
+				Tags:    []string{"integration"},
+				Timeout: "5m",
+				Race:    true,
+				Short:   true,
+				Cover:   true,
+				Env:     map[string]string{"K": "v"},
+			},
+		},
+		parallel:       4,
+		scriptTimeout:  time.Minute,
+		timeout:        time.Hour,
+		scriptTimeouts: map[string]time.Duration{"slow": 2 * time.Minute},
+		update:         true,
+		verbose:        true,
+	}
+	// Every field must be set, such that a field that is added to
+	// runModuleInfo but not to runSpec fails the round trip. The limits
+	// apply to the container that runs unity docker, so are not part of
+	// the spec.
+	v := reflect.ValueOf(info)
+	for i := 0; i < v.NumField(); i++ {
+		name := v.Type().Field(i).Name
+		if name != "limits" && v.Field(i).IsZero() {
+			t.Fatalf("runModuleInfo field %s is not set", name)
+		}
+	}
+
+	data, err := json.Marshal(newRunSpec(info))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var spec runSpec
+	if err := json.Unmarshal(data, &spec); err != nil {
+		t.Fatal(err)
+	}
+	if spec.SpecVersion != runSpecVersion {
+		t.Errorf("got spec version %d; want %d", spec.SpecVersion, runSpecVersion)
+	}
+	if got := spec.info(); !reflect.DeepEqual(got, info) {
+		t.Errorf("round trip of runModuleInfo:\ngot:  %+v\nwant: %+v", got, info)
+	}
+}
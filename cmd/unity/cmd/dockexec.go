@@ -102,11 +102,14 @@ func dockexecDef(c *Command, args []string) error {
 	}
 
 	// First, start with our docker flags.
+	name := containerName()
 	allDockerArgs := []string{
 		"run",
 
-		// Delete the container when we're done.
-		"--rm",
+		// Name the container, such that we can inspect it once it has
+		// stopped. We delete it ourselves when we're done, or a later unity
+		// removes it via its label.
+		"--name=" + name,
 
 		// Set up the test binary as the entrypoint.
 		fmt.Sprintf("--volume=%s:/init", binary),
@@ -126,6 +129,8 @@ func dockexecDef(c *Command, args []string) error {
 		fmt.Sprintf("--volume=%s:%s", tempHome, realHome),
 	}
 
+	allDockerArgs = append(allDockerArgs, containerLabelFlags()...)
+
 	// Ensure both systems agree on where $HOME is.
 	// We don't want discrepancies because of /etc/passwd or cgo.
 	// Note that this is HOME on most systems except Windows.
@@ -142,8 +147,21 @@ func dockexecDef(c *Command, args []string) error {
 	}
 	allDockerArgs = append(allDockerArgs, contextDockerFlags...)
 
-	// Then, add the user's docker flags.
-	allDockerArgs = append(allDockerArgs, dockerFlags...)
+	// Then, add the user's docker flags, expanding any environment that unity
+	// encodes to survive go test's splitting of -exec.
+	for _, f := range dockerFlags {
+		if !strings.HasPrefix(f, envFlagPrefix) {
+			allDockerArgs = append(allDockerArgs, f)
+			continue
+		}
+		env, err := parseEnvFlag(f)
+		if err != nil {
+			return err
+		}
+		for _, kv := range env {
+			allDockerArgs = append(allDockerArgs, "-e", kv)
+		}
+	}
 
 	// Add "--" to stop all docker flags if we are not in compose mode.
 	// docker-compose does not (yet) know how to handle --:
@@ -168,7 +186,14 @@ func dockexecDef(c *Command, args []string) error {
 	cmd.Stdin = os.Stdin
 	cmd.Stdout = os.Stdout
 	cmd.Stderr = os.Stderr
+	defer removeContainer(name)
 	if err := cmd.Run(); err != nil {
+		if containerOOMKilled(name) {
+			// Tell unity via the output of go test, which only reports
+			// that the test binary failed
+			fmt.Printf("%s%s\n", goTestOOMMarker, filepath.Base(binary))
+			return fmt.Errorf("%s ran out of memory: %v", filepath.Base(binary), err)
+		}
 		return err
 	}
 	return nil
@@ -181,7 +206,11 @@ func dockexecDef(c *Command, args []string) error {
 // * ad hoc mode
 //
 // For all the scenarios below the test binary will be mounted as /init;
-// GOMODCACHE and GOCACHE are made available at canonical locations.
+// GOMODCACHE is made available read-only at a canonical location, such that
+// tests cannot tamper with the module cache of the host. The build cache of
+// the host is not made available at all, because go cannot use a read-only
+// build cache. Tests that run go get an empty build cache in the temporary
+// home directory instead, which is the default GOCACHE.
 //
 // Module-aware mode
 // -----------------
@@ -208,7 +237,6 @@ func buildDockerFlags() ([]string, error) {
 
 	var env struct {
 		GOMODCACHE string
-		GOCACHE    string
 		GOMOD      string
 	}
 	envCmd := exec.Command("go", "env", "-json")
@@ -224,10 +252,8 @@ func buildDockerFlags() ([]string, error) {
 		// Use -e to specify environment variables, as this flag is common to both
 		// docker and docker-compose (--env is not an option with docker-compose).
 		// TODO: when docker-compose v2 is widespread, switch to --env=NAME=VAL.
-		fmt.Sprintf("--volume=%v:/gomodcache", env.GOMODCACHE),
+		fmt.Sprintf("--volume=%v:/gomodcache:ro", env.GOMODCACHE),
 		"-e", "GOMODCACHE=/gomodcache",
-		fmt.Sprintf("--volume=%v:/gocache", env.GOCACHE),
-		"-e", "GOCACHE=/gocache",
 	)
 
 	wd, err := os.Getwd()
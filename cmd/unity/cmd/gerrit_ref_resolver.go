@@ -33,19 +33,41 @@ func newGerritRefResolver(c resolverConfig) (resolver, error) {
 	return res, nil
 }
 
-func (g *gerritRefResolver) resolve(version, _, _, target string) (string, error) {
+func (g *gerritRefResolver) resolve(version, _, working, target string) (string, error) {
+	strategy, err := g.strategy(version)
+	if err != nil {
+		return "", err
+	}
+	return g.cc.resolve(version, working, target, strategy)
+}
+
+func (g *gerritRefResolver) goModReplace(version, _, working string) (string, error) {
+	strategy, err := g.strategy(version)
+	if err != nil {
+		return "", err
+	}
+	return g.cc.sourceWorktree(version, working, strategy)
+}
+
+func (g *gerritRefResolver) check(version string) error {
+	_, err := g.strategy(version)
+	return err
+}
+
+// strategy returns the strategy for resolving version within the CUE clone.
+func (g *gerritRefResolver) strategy(version string) (cueStrategy, error) {
 	if !strings.HasPrefix(version, "refs/changes/") {
-		return "", errNoMatch
+		return nil, errNoMatch
 	}
-	return g.cc.resolve(version, target, func(c *commonCUEResolver) (string, error) {
+	return func(c *commonCUEResolver) (string, string, error) {
 		// fetch the version
-		if _, err := gitDir(c.dir, "fetch", cueGitSource, version); err != nil {
-			return "", fmt.Errorf("failed to fetch %s: %v", version, err)
+		if _, err := gitDir(c.dir, "fetch", c.source, version); err != nil {
+			return "", "", fmt.Errorf("failed to fetch %s: %v", version, err)
 		}
-		// move to FETCH_HEAD
-		if _, err := gitDir(c.dir, "checkout", "FETCH_HEAD"); err != nil {
-			return "", fmt.Errorf("failed to checkout FETCH_HEAD: %v", err)
+		commit, err := c.revParse("FETCH_HEAD")
+		if err != nil {
+			return "", "", err
 		}
-		return version, nil
-	})
+		return version, commit, nil
+	}, nil
 }
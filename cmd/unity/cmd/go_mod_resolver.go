@@ -40,3 +40,18 @@ func (a *goModResolver) resolve(version, dir, workingDir, target string) (string
 	}
 	return fmt.Sprintf("%s (%s)", version, commit), nil
 }
+
+func (a *goModResolver) goModReplace(version, dir, workingDir string) (string, error) {
+	if version != "go.mod" {
+		return "", errNoMatch
+	}
+	// By definition, Go tests already use this version of CUE
+	return "", nil
+}
+
+func (a *goModResolver) check(version string) error {
+	if version != "go.mod" {
+		return errNoMatch
+	}
+	return nil
+}
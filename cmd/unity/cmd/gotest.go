@@ -0,0 +1,221 @@
+// Copyright 2023 The CUE Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/cue-unity/unity"
+)
+
+// goTestResult is the result of a single top-level Go test, or of a package
+// that failed without running any tests, e.g. because of a build failure.
+type goTestResult struct {
+	pkg  string
+	test string
+
+	// action is the final action reported by go test: pass, fail or skip.
+	// A package whose test binary ran out of memory in safe mode has the
+	// action oom.
+	action string
+
+	elapsed time.Duration
+}
+
+// status returns the status of r in the style of the results table.
+func (r goTestResult) status() string {
+	switch r.action {
+	case "pass":
+		return "ok"
+	case "skip":
+		return "SKIP"
+	case "oom":
+		return "OOM"
+	}
+	return "FAIL"
+}
+
+// name returns the package and test name of r.
+func (r goTestResult) name() string {
+	if r.test == "" {
+		return r.pkg
+	}
+	return r.pkg + " " + r.test
+}
+
+// goTestGroup is a set of package patterns that share the same go test flags,
+// and can therefore be tested by a single go test invocation.
+type goTestGroup struct {
+	patterns []string
+
+	// args are the flags to go test
+	args []string
+
+	// env is the extra environment for go test and the test binaries
+	env []string
+
+	// race indicates that the race detector is enabled
+	race bool
+}
+
+// goTestGroups groups the package patterns in goTests by their flags, such
+// that we use as few go test invocations as possible. In the common case of
+// all patterns sharing the same flags, that is a single invocation. Groups
+// and their patterns are sorted for the sake of determinism.
+func goTestGroups(goTests map[string]unity.GoTestFlags) []*goTestGroup {
+	var patterns []string
+	for pattern := range goTests {
+		patterns = append(patterns, pattern)
+	}
+	sort.Strings(patterns)
+
+	var res []*goTestGroup
+	groups := make(map[string]*goTestGroup)
+	for _, pattern := range patterns {
+		flags := goTests[pattern]
+		args := goTestArgs(flags)
+		var env []string
+		for k, v := range flags.Env {
+			env = append(env, k+"="+v)
+		}
+		sort.Strings(env)
+		key := strings.Join(args, "\x00") + "\x00\x00" + strings.Join(env, "\x00")
+		g, ok := groups[key]
+		if !ok {
+			g = &goTestGroup{
+				args: args,
+				env:  env,
+				race: flags.Race,
+			}
+			groups[key] = g
+			res = append(res, g)
+		}
+		g.patterns = append(g.patterns, pattern)
+	}
+	return res
+}
+
+// goTestArgs returns the go test flags corresponding to flags.
+func goTestArgs(flags unity.GoTestFlags) []string {
+	var args []string
+	for _, pattern := range flags.Run {
+		args = append(args, "-run="+pattern)
+	}
+	for _, pattern := range flags.Skip {
+		args = append(args, "-skip="+pattern)
+	}
+	if len(flags.Tags) > 0 {
+		args = append(args, "-tags="+strings.Join(flags.Tags, ","))
+	}
+	if flags.Timeout != "" {
+		args = append(args, "-timeout="+flags.Timeout)
+	}
+	if flags.Race {
+		args = append(args, "-race")
+	}
+	if flags.Short {
+		args = append(args, "-short")
+	}
+	if flags.Cover {
+		args = append(args, "-cover")
+	}
+	return args
+}
+
+// goTestEvent is an event emitted by go test -json, as documented by
+// go doc test2json.
+type goTestEvent struct {
+	Action  string
+	Package string
+	Test    string
+	Elapsed float64
+	Output  string
+}
+
+// goTestFailedRx matches the line printed by go test for a package that
+// failed to build.
+var goTestFailedRx = regexp.MustCompile(`^FAIL\t(\S+) \[(build|setup) failed\]$`)
+
+// parseGoTestJSON reads the output of go test -json from r, writing the
+// human-readable test output to log. It returns the results of the top-level
+// tests, along with any packages that failed without a failing test or whose
+// test binary ran out of memory. Lines that are not JSON, such as build
+// errors, are written to log as they are.
+func parseGoTestJSON(r io.Reader, log io.Writer) ([]goTestResult, error) {
+	var res []goTestResult
+	failedTests := make(map[string]bool)
+	oomPackages := make(map[string]bool)
+	sc := bufio.NewScanner(r)
+	sc.Buffer(nil, 1<<20)
+	for sc.Scan() {
+		line := sc.Bytes()
+		var ev goTestEvent
+		if err := json.Unmarshal(line, &ev); err != nil || ev.Action == "" {
+			fmt.Fprintf(log, "%s\n", line)
+			// Before Go 1.24, build failures are only reported as text
+			if m := goTestFailedRx.FindSubmatch(line); m != nil {
+				res = append(res, goTestResult{
+					pkg:    string(m[1]),
+					action: "fail",
+				})
+			}
+			continue
+		}
+		switch ev.Action {
+		case "output", "build-output":
+			io.WriteString(log, ev.Output)
+			if strings.HasPrefix(ev.Output, goTestOOMMarker) {
+				oomPackages[ev.Package] = true
+			}
+			continue
+		case "pass", "fail", "skip":
+		default:
+			continue
+		}
+		if strings.Contains(ev.Test, "/") {
+			// Subtests are reported as part of their top-level test
+			continue
+		}
+		if ev.Test == "" && ev.Action == "fail" && oomPackages[ev.Package] {
+			// Report the package even if failing tests explain its failure,
+			// as they only failed because the test binary was killed
+			ev.Action = "oom"
+		} else if ev.Test == "" && (ev.Action != "fail" || failedTests[ev.Package]) {
+			// Only report a package when its failure is not otherwise
+			// explained by a failing test
+			continue
+		}
+		if ev.Action == "fail" {
+			failedTests[ev.Package] = true
+		}
+		res = append(res, goTestResult{
+			pkg:     ev.Package,
+			test:    ev.Test,
+			action:  ev.Action,
+			elapsed: time.Duration(ev.Elapsed * float64(time.Second)),
+		})
+	}
+	if err := sc.Err(); err != nil {
+		return res, fmt.Errorf("failed to read go test output: %v", err)
+	}
+	return res, nil
+}
@@ -0,0 +1,321 @@
+// Copyright 2023 The CUE Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"go/format"
+	"io"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"regexp"
+	"runtime/debug"
+	"sort"
+	"strings"
+	"text/template"
+	"time"
+
+	"cuelang.org/go/cue/errors"
+	"github.com/cue-unity/unity/internal/scriptparams"
+)
+
+const (
+	// goInternalModule is the module that provides testscript
+	goInternalModule = "github.com/rogpeppe/go-internal"
+
+	// scriptsModuleDir is the name of the directory within a run's working
+	// directory in which we generate the module that runs the test scripts
+	// via go test
+	scriptsModuleDir = "scripts-module"
+)
+
+// scriptsModuleTmpl is the template for the test in the temporary module that
+// runs the test scripts of a module via go test. The test uses a copy of
+// package scriptparams, such that scripts run exactly as they do in process
+// via runModule.
+var scriptsModuleTmpl = template.Must(template.New("").Parse(`// Code generated by unity. DO NOT EDIT.
+
+package scripts
+
+import (
+	"testing"
+
+	"github.com/rogpeppe/go-internal/testscript"
+
+	"unity.test/scripts/scriptparams"
+)
+
+func TestScripts(t *testing.T) {
+	testscript.Run(t, {{printf "%#v" .}}.Params())
+}
+`))
+
+// goTestRunModule is an alternative to runModule and dockerRunModule which
+// runs the test scripts of a module via go test, in the temporary module dir
+// written by writeScriptsModule. Scripts then run in parallel according to
+// go test -parallel, and in safe mode they share the dockexec sandbox used
+// for Go tests.
+//
+// The module timeout is enforced via ctx, but per-script timeouts are not
+// supported, because go test only has a timeout for the whole test binary.
+func (mt *moduleTester) goTestRunModule(ctx context.Context, log io.Writer, info runModuleInfo, dir string) ([]scriptResult, error) {
+	testArgs := []string{"test",
+		"-vet=off",
+		"-count=1",
+		"-json",
+		fmt.Sprintf("-parallel=%d", info.parallel),
+	}
+	if !mt.unsafe && mt.sandbox == sandboxNamespace {
+		s := sandbox{
+			ro:      []string{dir, filepath.Dir(info.cuePath)},
+			rw:      []string{info.workdirRoot},
+			network: info.limits.network,
+		}
+		if info.update {
+			s.rw = append(s.rw, info.manifestDir)
+		} else {
+			s.ro = append(s.ro, info.manifestDir)
+		}
+		flag, err := nsexecFlag(mt.self, s)
+		if err != nil {
+			return nil, err
+		}
+		testArgs = append(testArgs, flag)
+	} else if !mt.unsafe {
+		// Mount everything the scripts need at the same paths as on the
+		// host, such that the generated test does not need to know whether
+		// it runs in a container. As with the namespace sandbox, only
+		// updates are written to the manifest directory.
+		execArgs := []string{mt.self, "dockexec", dockerImageDefault}
+		execArgs = append(execArgs, info.limits.dockerFlags()...)
+		manifestMode := ":ro"
+		if info.update {
+			manifestMode = ""
+		}
+		execArgs = append(execArgs,
+			fmt.Sprintf("-v=%s:%s%s", info.manifestDir, info.manifestDir, manifestMode),
+			fmt.Sprintf("-v=%s:%s", info.workdirRoot, info.workdirRoot),
+			fmt.Sprintf("-v=%s:%s", filepath.Dir(info.cuePath), filepath.Dir(info.cuePath)),
+		)
+		flag, err := execFlag(execArgs...)
+		if err != nil {
+			return nil, err
+		}
+		testArgs = append(testArgs, flag)
+	}
+	testArgs = append(testArgs, ".")
+	cmd := exec.CommandContext(ctx, "go", testArgs...)
+	cmd.WaitDelay = time.Second
+	cmd.Dir = dir
+	cmd.Env = os.Environ()
+	if !mt.unsafe {
+		cmd.Env = append(cmd.Env, mt.buildHelper.buildEnv()...)
+	}
+
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	// Buffer stderr separately, because it is written concurrently with
+	// our parsing of stdout
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	scripts, parseErr := parseScriptsJSON(stdout, log, info)
+	// Don't leave go test blocked on output that we failed to parse
+	io.Copy(log, stdout)
+	err = cmd.Wait()
+	log.Write(stderr.Bytes())
+	if ctx.Err() != nil {
+		return scripts, errTestTimeout
+	}
+	if errors.Is(parseErr, errTestOOM) {
+		return scripts, parseErr
+	}
+	if err != nil {
+		var exitError *exec.ExitError
+		if errors.As(err, &exitError) {
+			return scripts, errTestFail
+		}
+		return scripts, err
+	}
+	return scripts, parseErr
+}
+
+// goTestLogRx matches the prefix of the first line of a message logged by a
+// test, which go test adds, and after which the lines of the message are
+// indented.
+var goTestLogRx = regexp.MustCompile(`^[a-zA-Z0-9_.-]+\.go:[0-9]+: `)
+
+// parseScriptsJSON parses the go test -json output of the test in the module
+// written by writeScriptsModule from r, writing the log of each script to log
+// in the same way as runModule: failed scripts, or all scripts if
+// info.verbose. Any other output is written to log as is. It returns the
+// result of each script, and errTestOOM if the test binary ran out of memory
+// in safe mode.
+func parseScriptsJSON(r io.Reader, log io.Writer, info runModuleInfo) ([]scriptResult, error) {
+	const testPrefix = "TestScripts/"
+	outputs := make(map[string]*bytes.Buffer)
+	statuses := make(map[string]string)
+	elapsed := make(map[string]time.Duration)
+	oom := false
+	sc := bufio.NewScanner(r)
+	sc.Buffer(nil, 1<<20)
+	for sc.Scan() {
+		line := sc.Bytes()
+		var ev goTestEvent
+		if err := json.Unmarshal(line, &ev); err != nil || ev.Action == "" {
+			fmt.Fprintf(log, "%s\n", line)
+			continue
+		}
+		if ev.Action == "output" && strings.HasPrefix(ev.Output, goTestOOMMarker) {
+			io.WriteString(log, ev.Output)
+			oom = true
+			continue
+		}
+		name := strings.TrimPrefix(ev.Test, testPrefix)
+		if name == ev.Test || strings.Contains(name, "/") {
+			if ev.Action == "output" || ev.Action == "build-output" {
+				io.WriteString(log, ev.Output)
+			}
+			continue
+		}
+		switch ev.Action {
+		case "output":
+			// Drop the framing of go test, leaving the log of the script
+			out := strings.TrimPrefix(ev.Output, "    ")
+			if strings.HasPrefix(out, "=== ") || strings.HasPrefix(out, "--- ") {
+				continue
+			}
+			if m := goTestLogRx.FindString(out); m != "" {
+				out = out[len(m):]
+			} else {
+				out = strings.TrimPrefix(out, "    ")
+			}
+			if outputs[name] == nil {
+				outputs[name] = new(bytes.Buffer)
+			}
+			outputs[name].WriteString(out)
+		case "pass":
+			statuses[name] = "PASS"
+		case "fail":
+			statuses[name] = "FAIL"
+		case "skip":
+			statuses[name] = "SKIP"
+		}
+		if ev.Action == "pass" || ev.Action == "fail" || ev.Action == "skip" {
+			elapsed[name] = time.Duration(ev.Elapsed * float64(time.Second))
+		}
+	}
+	var names []string
+	for name := range statuses {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var scripts []scriptResult
+	for _, name := range names {
+		status := statuses[name]
+		sr := scriptResult{name: name, status: status, elapsed: elapsed[name]}
+		if status != "FAIL" && !info.verbose {
+			scripts = append(scripts, sr)
+			continue
+		}
+		var context []string
+		if info.testerRelPath != "" {
+			context = append(context, info.testerRelPath)
+		}
+		context = append(context, name, info.version)
+		output := outputs[name]
+		if output == nil {
+			output = new(bytes.Buffer)
+		}
+		sr.output = output.String()
+		scripts = append(scripts, sr)
+		fmt.Fprintf(log, "--- %s: %s\n%s", status, path.Join(context...), indent(output, "\t"))
+	}
+	if err := sc.Err(); err != nil {
+		return scripts, fmt.Errorf("failed to read go test output: %v", err)
+	}
+	if oom {
+		return scripts, errTestOOM
+	}
+	return scripts, nil
+}
+
+// writeScriptsModule writes the module used by goTestRunModule to dir. The
+// module requires the same version of go-internal that unity was built with,
+// which is therefore normally in the module cache already.
+func (mt *moduleTester) writeScriptsModule(dir string, info runModuleInfo) error {
+	bi, ok := debug.ReadBuildInfo()
+	if !ok {
+		return fmt.Errorf("failed to read build information of unity")
+	}
+	var goInternal *debug.Module
+	for _, d := range bi.Deps {
+		if d.Path == goInternalModule {
+			goInternal = d
+			if d.Replace != nil {
+				goInternal = d.Replace
+			}
+		}
+	}
+	if goInternal == nil {
+		return fmt.Errorf("failed to determine the version of %s that unity was built with", goInternalModule)
+	}
+
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		return fmt.Errorf("failed to create %s: %v", dir, err)
+	}
+	gomod := fmt.Sprintf("module unity.test/scripts\n\ngo 1.18\n\nrequire %s %s\n", goInternalModule, goInternal.Version)
+	if goInternal.Path != goInternalModule {
+		gomod += fmt.Sprintf("\nreplace %s => %s %s\n", goInternalModule, goInternal.Path, goInternal.Version)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "go.mod"), []byte(gomod), 0666); err != nil {
+		return fmt.Errorf("failed to write go.mod: %v", err)
+	}
+	paramsDir := filepath.Join(dir, "scriptparams")
+	if err := os.MkdirAll(paramsDir, 0777); err != nil {
+		return fmt.Errorf("failed to create %s: %v", paramsDir, err)
+	}
+	if err := os.WriteFile(filepath.Join(paramsDir, "scriptparams.go"), []byte(scriptparams.Source), 0666); err != nil {
+		return fmt.Errorf("failed to write scriptparams: %v", err)
+	}
+	var buf bytes.Buffer
+	err := scriptsModuleTmpl.Execute(&buf, info.scriptConfig())
+	if err != nil {
+		return fmt.Errorf("failed to generate scripts test: %v", err)
+	}
+	src, err := format.Source(buf.Bytes())
+	if err != nil {
+		return fmt.Errorf("failed to format scripts test: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "scripts_test.go"), src, 0666); err != nil {
+		return fmt.Errorf("failed to write scripts test: %v", err)
+	}
+	cmd := exec.Command("go", "mod", "tidy")
+	cmd.Dir = dir
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("failed to run [%v] in %s: %v\n%s", cmd, dir, err, out)
+	}
+	return nil
+}
@@ -0,0 +1,57 @@
+// Copyright 2023 The CUE Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"errors"
+	"io"
+	"strings"
+	"testing"
+)
+
+// goTestOOMOutput is the go test -json output of a package whose test binary
+// was killed for running out of memory in safe mode, after which dockexec
+// wrote the OOM marker.
+const goTestOOMOutput = `{"Action":"start","Package":"mod.com/x"}
+{"Action":"run","Package":"mod.com/x","Test":"TestBig"}
+{"Action":"output","Package":"mod.com/x","Test":"TestBig","Output":"=== RUN   TestBig\n"}
+{"Action":"output","Package":"mod.com/x","Test":"TestBig","Output":"` + goTestOOMMarker + `x.test\n"}
+{"Action":"fail","Package":"mod.com/x","Test":"TestBig","Elapsed":1}
+{"Action":"output","Package":"mod.com/x","Output":"FAIL\tmod.com/x\t1.000s\n"}
+{"Action":"fail","Package":"mod.com/x","Elapsed":1}
+`
+
+func TestParseGoTestJSONOOM(t *testing.T) {
+	results, err := parseGoTestJSON(strings.NewReader(goTestOOMOutput), io.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var statuses []string
+	for _, r := range results {
+		statuses = append(statuses, r.name()+" "+r.status())
+	}
+	got := strings.Join(statuses, "\n")
+	want := "mod.com/x TestBig FAIL\nmod.com/x OOM"
+	if got != want {
+		t.Fatalf("got results:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestParseScriptsJSONOOM(t *testing.T) {
+	_, err := parseScriptsJSON(strings.NewReader(goTestOOMOutput), io.Discard, runModuleInfo{})
+	if !errors.Is(err, errTestOOM) {
+		t.Fatalf("got error %v; want %v", err, errTestOOM)
+	}
+}
@@ -0,0 +1,260 @@
+// Copyright 2023 The CUE Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"cuelang.org/go/cue/load"
+	"github.com/spf13/cobra"
+	"golang.org/x/mod/modfile"
+)
+
+// starterScriptHeader is the header of the test scripts scaffolded by unity
+// init.
+const starterScriptHeader = `# Starter test scaffolded by unity init. It verifies that the package is valid
+# and that it evaluates as before. Replace or extend it with tests that
+# exercise the module.
+`
+
+// newInitCmd creates the init command
+func newInitCmd(c *Command) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "init [versions...]",
+		Short: "scaffold tests for the CUE modules of a project",
+		Long: `
+init scaffolds a cue.mod/tests directory for each of the CUE modules of the git
+repository that contains --dir, found in the same way as unity test. Modules
+that already have a cue.mod/tests directory are left as they are.
+
+The manifest's Versions are those given as arguments. Otherwise they are go.mod
+if the module is within a Go module that depends on cuelang.org/go, and the
+latest release of CUE if not.
+
+For each package of a module, init writes a test script that runs cue vet and
+cue eval, with the output of cue eval as golden output. The output is that of
+the first of the Versions.
+`,
+		RunE: mkRunE(c, initDef),
+	}
+	cmd.Flags().StringP(string(flagTestDir), "d", ".", "a directory within the project")
+	return cmd
+}
+
+func initDef(c *Command, args []string) error {
+	gitRoot, err := gitDir(flagTestDir.String(c), "rev-parse", "--show-toplevel")
+	if err != nil {
+		return fmt.Errorf("failed to determine git root: %v", err)
+	}
+	gitRoot = strings.TrimSpace(gitRoot)
+
+	roots, err := findModuleRoots(gitRoot)
+	if err != nil {
+		return fmt.Errorf("failed to find CUE modules in %s: %v", gitRoot, err)
+	}
+	if len(roots) == 0 {
+		return fmt.Errorf("could not find any CUE module roots under %s", gitRoot)
+	}
+
+	bh, err := newBuildHelper()
+	if err != nil {
+		return fmt.Errorf("failed to create build helper: %v", err)
+	}
+	defer bh.cache.Trim()
+	vr, err := newVersionResolver(resolverConfig{
+		bh:        bh,
+		allowPATH: true,
+		debug:     flagDebug.Bool(c),
+	})
+	if err != nil {
+		return fmt.Errorf("could not create version resolver: %v", err)
+	}
+	working, err := os.MkdirTemp("", "unity-init")
+	if err != nil {
+		return fmt.Errorf("failed to create working directory: %v", err)
+	}
+	defer os.RemoveAll(working)
+
+	for _, root := range roots {
+		rel, err := filepath.Rel(gitRoot, root)
+		if err != nil {
+			return err
+		}
+		testsDir := filepath.Join(root, "cue.mod", packageTests)
+		if _, err := os.Stat(testsDir); err == nil {
+			fmt.Fprintf(os.Stderr, "%s already has a tests directory\n", rel)
+			continue
+		}
+		versions := args
+		if len(versions) == 0 {
+			v, err := defaultInitVersion(gitRoot, root, working)
+			if err != nil {
+				return err
+			}
+			versions = []string{v}
+		}
+
+		// Resolve the first version to generate the golden output
+		td, err := os.MkdirTemp(working, "version")
+		if err != nil {
+			return fmt.Errorf("failed to create working directory: %v", err)
+		}
+		cuePath := filepath.Join(td, "cue")
+		base, env := parseVersionEnv(versions[0])
+		if _, err := vr.resolve(base, root, td, cuePath); err != nil {
+			return fmt.Errorf("failed to resolve %s for %s: %v", versions[0], rel, err)
+		}
+
+		if err := os.MkdirAll(testsDir, 0777); err != nil {
+			return fmt.Errorf("failed to create tests directory: %v", err)
+		}
+		if err := writeManifest(testsDir, versions); err != nil {
+			return err
+		}
+		n, err := writeStarterScripts(testsDir, root, cuePath, env)
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			fmt.Fprintf(os.Stderr, "no CUE packages to test in %s; add test scripts to %s\n", rel, testsDir)
+		}
+		fmt.Fprintf(os.Stderr, "scaffolded %s with %d test scripts for %s\n", testsDir, n, strings.Join(versions, ", "))
+	}
+	return nil
+}
+
+// defaultInitVersion returns the CUE version of the manifest scaffolded for
+// the module at root within gitRoot: go.mod if the module is within a Go
+// module that depends on CUE, and the latest release of CUE otherwise.
+func defaultInitVersion(gitRoot, root, working string) (string, error) {
+	for dir := root; ; dir = filepath.Dir(dir) {
+		gomod := filepath.Join(dir, "go.mod")
+		if data, err := os.ReadFile(gomod); err == nil {
+			mf, err := modfile.ParseLax(gomod, data, nil)
+			if err != nil {
+				return "", fmt.Errorf("failed to parse %s: %v", gomod, err)
+			}
+			if mf.Module != nil && mf.Module.Mod.Path == cueModule {
+				return "go.mod", nil
+			}
+			for _, r := range mf.Require {
+				if r.Mod.Path == cueModule {
+					return "go.mod", nil
+				}
+			}
+			// The nearest go.mod determines the Go module
+			break
+		}
+		if dir == gitRoot || dir == filepath.Dir(dir) {
+			break
+		}
+	}
+
+	// Query the latest release outside of any Go module
+	cmd := exec.Command("go", "list", "-m", "-json", cueModule+"@latest")
+	cmd.Dir = working
+	cmd.Env = append(os.Environ(), "GO111MODULE=on", "GOFLAGS=-mod=mod")
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("failed to determine the latest release of CUE via [%v]: %v\n%s", cmd, err, out)
+	}
+	var latest struct {
+		Version string
+	}
+	if err := json.Unmarshal(out, &latest); err != nil {
+		return "", fmt.Errorf("failed to parse module information: %v\n%s", err, out)
+	}
+	return latest.Version, nil
+}
+
+// writeStarterScripts writes a starter test script to testsDir for each of
+// the packages of the module at root, using the cue binary at cuePath with
+// the additional environment env to generate golden output. It returns the
+// number of scripts written. Packages that fail cue vet or cue eval are
+// skipped with a warning.
+func writeStarterScripts(testsDir, root, cuePath string, env []string) (int, error) {
+	runCUE := func(args ...string) ([]byte, error) {
+		cmd := exec.Command(cuePath, args...)
+		cmd.Dir = root
+		cmd.Env = append(os.Environ(), env...)
+		var stdout, stderr bytes.Buffer
+		cmd.Stdout = &stdout
+		cmd.Stderr = &stderr
+		if err := cmd.Run(); err != nil {
+			return nil, fmt.Errorf("%v\n%s", err, bytes.TrimSpace(stderr.Bytes()))
+		}
+		return stdout.Bytes(), nil
+	}
+
+	n := 0
+	for _, inst := range load.Instances([]string{"./..."}, &load.Config{Dir: root}) {
+		if inst.Err != nil {
+			fmt.Fprintf(os.Stderr, "skipping package: %v\n", inst.Err)
+			continue
+		}
+		if inNestedModule(root, inst.Dir) {
+			continue
+		}
+		rel, err := filepath.Rel(root, inst.Dir)
+		if err != nil {
+			return n, err
+		}
+		pkg := "."
+		name := "eval"
+		if rel != "." {
+			pkg = "./" + filepath.ToSlash(rel)
+			name += "_" + strings.ReplaceAll(filepath.ToSlash(rel), "/", "_")
+		}
+		if _, err := runCUE("vet", pkg); err != nil {
+			fmt.Fprintf(os.Stderr, "skipping package %s which fails cue vet: %v\n", pkg, err)
+			continue
+		}
+		golden, err := runCUE("eval", pkg)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "skipping package %s which fails cue eval: %v\n", pkg, err)
+			continue
+		}
+		if len(golden) > 0 && !bytes.HasSuffix(golden, []byte("\n")) {
+			golden = append(golden, '\n')
+		}
+		var buf bytes.Buffer
+		buf.WriteString(starterScriptHeader)
+		fmt.Fprintf(&buf, "cue vet %s\ncue eval %s\ncmp stdout $WORK/eval.golden\n\n-- eval.golden --\n", pkg, pkg)
+		buf.Write(golden)
+		script := filepath.Join(testsDir, name+".txtar")
+		if err := os.WriteFile(script, buf.Bytes(), 0666); err != nil {
+			return n, fmt.Errorf("failed to write test script: %v", err)
+		}
+		n++
+	}
+	return n, nil
+}
+
+// inNestedModule reports whether dir, which is within the module at root, is
+// within another CUE module nested within it.
+func inNestedModule(root, dir string) bool {
+	for ; dir != root && dir != filepath.Dir(dir); dir = filepath.Dir(dir) {
+		if fi, err := os.Stat(filepath.Join(dir, "cue.mod")); err == nil && fi.IsDir() {
+			return true
+		}
+	}
+	return false
+}
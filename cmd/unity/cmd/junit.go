@@ -0,0 +1,163 @@
+// Copyright 2023 The CUE Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"encoding/xml"
+	"fmt"
+	"os"
+)
+
+// junitTestSuites is the root element of a JUnit XML report, as understood by
+// CI systems.
+type junitTestSuites struct {
+	XMLName xml.Name         `xml:"testsuites"`
+	Suites  []junitTestSuite `xml:"testsuite"`
+}
+
+// junitTestSuite is the JUnit test suite of a module tested against a
+// version.
+type junitTestSuite struct {
+	Name     string          `xml:"name,attr"`
+	Tests    int             `xml:"tests,attr"`
+	Failures int             `xml:"failures,attr"`
+	Errors   int             `xml:"errors,attr"`
+	Skipped  int             `xml:"skipped,attr"`
+	Time     string          `xml:"time,attr"`
+	Cases    []junitTestCase `xml:"testcase"`
+}
+
+type junitTestCase struct {
+	Classname string        `xml:"classname,attr"`
+	Name      string        `xml:"name,attr"`
+	Time      string        `xml:"time,attr,omitempty"`
+	Failure   *junitMessage `xml:"failure,omitempty"`
+	Error     *junitMessage `xml:"error,omitempty"`
+	Skipped   *junitMessage `xml:"skipped,omitempty"`
+}
+
+type junitMessage struct {
+	Message  string `xml:"message,attr,omitempty"`
+	Contents string `xml:",chardata"`
+}
+
+// writeJUnit writes the results of tested, along with the paths of the corpus
+// projects that were skipped, to the file path as a JUnit XML report. Each
+// module and version is a test suite, with a test case for each Go test and
+// each test script.
+func writeJUnit(path string, tested []*testResult, skipped []string) error {
+	var res junitTestSuites
+	for _, tr := range tested {
+		res.Suites = append(res.Suites, junitSuite(tr))
+	}
+	for _, p := range skipped {
+		res.Suites = append(res.Suites, junitTestSuite{
+			Name:    p,
+			Tests:   1,
+			Skipped: 1,
+			Cases: []junitTestCase{{
+				Classname: p,
+				Name:      p,
+				Skipped:   &junitMessage{Message: "submodule is not initialised"},
+			}},
+		})
+	}
+	data, err := xml.MarshalIndent(res, "", "\t")
+	if err != nil {
+		return fmt.Errorf("failed to encode JUnit report: %v", err)
+	}
+	data = append([]byte(xml.Header), data...)
+	if err := os.WriteFile(path, append(data, '\n'), 0666); err != nil {
+		return fmt.Errorf("failed to write JUnit report: %v", err)
+	}
+	return nil
+}
+
+// junitSuite returns the JUnit test suite of tr.
+func junitSuite(tr *testResult) junitTestSuite {
+	name := tr.module.path
+	if tr.module.testerRelPath != "" {
+		name = tr.module.testerRelPath
+	}
+	suite := junitTestSuite{
+		Name: name + " " + tr.resolvedVersion,
+		Time: junitSeconds(tr.duration.Seconds()),
+	}
+	add := func(c junitTestCase) {
+		suite.Tests++
+		switch {
+		case c.Failure != nil:
+			suite.Failures++
+		case c.Error != nil:
+			suite.Errors++
+		case c.Skipped != nil:
+			suite.Skipped++
+		}
+		suite.Cases = append(suite.Cases, c)
+	}
+	for _, r := range tr.goTests {
+		c := junitTestCase{
+			Classname: r.pkg,
+			Name:      r.test,
+			Time:      junitSeconds(r.elapsed.Seconds()),
+		}
+		if r.test == "" {
+			// A package that failed without a failing test, e.g. because
+			// it failed to build
+			c.Name = r.pkg
+		}
+		switch r.action {
+		case "fail":
+			c.Failure = &junitMessage{Message: "FAIL"}
+		case "skip":
+			c.Skipped = &junitMessage{}
+		}
+		add(c)
+	}
+	for _, r := range tr.scripts {
+		c := junitTestCase{
+			Classname: name,
+			Name:      r.name,
+			Time:      junitSeconds(r.elapsed.Seconds()),
+		}
+		switch r.status {
+		case "FAIL", "TIMEOUT":
+			c.Failure = &junitMessage{Message: r.status, Contents: r.output}
+		case "SKIP":
+			c.Skipped = &junitMessage{}
+		}
+		add(c)
+	}
+	if tr.err != nil && suite.Failures == 0 {
+		// An error that was not attributed to a Go test or script, e.g. a
+		// failure to resolve the version
+		c := junitTestCase{
+			Classname: name,
+			Name:      "unity",
+		}
+		if isTestFailure(tr.err) {
+			c.Failure = &junitMessage{Message: resultStatus(tr.err), Contents: tr.log.String()}
+		} else {
+			c.Error = &junitMessage{Message: tr.err.Error()}
+		}
+		add(c)
+	}
+	return suite
+}
+
+// junitSeconds formats seconds as a JUnit time attribute.
+func junitSeconds(seconds float64) string {
+	return fmt.Sprintf("%.3f", seconds)
+}
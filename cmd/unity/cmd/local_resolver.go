@@ -0,0 +1,223 @@
+// Copyright 2023 The CUE Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+const (
+	localVersionPrefix = "local:"
+)
+
+// localResolver resolves a "local:$dir" version, where $dir is a git
+// checkout of CUE that might contain uncommitted changes. The resolved version
+// is the HEAD commit of the checkout, along with a hash of any uncommitted
+// changes, such that different dirty states of the same commit are reported
+// as different versions. Builds are stored in the unity user cache keyed on
+// that resolved version, so the same dirty state is only built once.
+type localResolver struct {
+	config resolverConfig
+
+	// buildsLock guards access to builds
+	buildsLock sync.Mutex
+
+	// builds captures the once-only semantics of each
+	// resolved version we try to build
+	builds map[[32]byte]*localBuild
+}
+
+// localBuild is a build of a resolved version that is shared by concurrent
+// callers, all of which see the error of the build, if any.
+type localBuild struct {
+	once sync.Once
+	err  error
+}
+
+var _ resolver = (*localResolver)(nil)
+
+func newLocalResolver(c resolverConfig) (resolver, error) {
+	res := &localResolver{
+		config: c,
+		builds: make(map[[32]byte]*localBuild),
+	}
+	return res, nil
+}
+
+func (l *localResolver) resolve(version, _, _, target string) (string, error) {
+	root, err := localRoot(version)
+	if err != nil {
+		return "", err
+	}
+	if err := checkCUEModule(root); err != nil {
+		return "", err
+	}
+	rev, err := localRevision(root)
+	if err != nil {
+		return "", err
+	}
+	version = fmt.Sprintf("%s (%s)", version, rev)
+
+	h := l.config.bh.cueVersionHash(localVersionPrefix + rev)
+	key := h.Sum()
+	if ce, _, err := l.config.bh.cache.GetFile(key); err == nil {
+		l.config.debugf("using cached build of %s for %s", rev, root)
+		return version, copyExecutableFile(ce, target)
+	}
+	l.buildsLock.Lock()
+	b, ok := l.builds[key]
+	if !ok {
+		b = new(localBuild)
+		l.builds[key] = b
+	}
+	l.buildsLock.Unlock()
+	b.once.Do(func() {
+		b.err = l.build(key, root, target)
+		if b.err != nil {
+			// Allow a later resolve to retry the build
+			l.buildsLock.Lock()
+			delete(l.builds, key)
+			l.buildsLock.Unlock()
+		}
+	})
+	if b.err != nil {
+		return "", fmt.Errorf("failed to build CUE in %s: %v", root, b.err)
+	}
+	ce, _, err := l.config.bh.cache.GetFile(key)
+	if err != nil {
+		return "", fmt.Errorf("failed to resolve %s from cache after build", version)
+	}
+	return version, copyExecutableFile(ce, target)
+}
+
+func (l *localResolver) goModReplace(version, _, _ string) (string, error) {
+	// Use the checkout directly, such that uncommitted changes are included
+	return localRoot(version)
+}
+
+func (l *localResolver) check(version string) error {
+	if !strings.HasPrefix(version, localVersionPrefix) {
+		return errNoMatch
+	}
+	if strings.TrimPrefix(version, localVersionPrefix) == "" {
+		return fmt.Errorf("missing directory in %q", version)
+	}
+	return nil
+}
+
+// localRoot returns the root of the git checkout specified by version.
+func localRoot(version string) (string, error) {
+	if !strings.HasPrefix(version, localVersionPrefix) {
+		return "", errNoMatch
+	}
+	dir, err := filepath.Abs(strings.TrimPrefix(version, localVersionPrefix))
+	if err != nil {
+		return "", fmt.Errorf("failed to make %s absolute: %v", version, err)
+	}
+	root, err := gitDir(dir, "rev-parse", "--show-toplevel")
+	if err != nil {
+		return "", fmt.Errorf("failed to determine git root of %s: %v", dir, err)
+	}
+	return strings.TrimSpace(root), nil
+}
+
+// build builds cmd/cue in root, storing the result in the cache under key.
+// target is used as the build output.
+func (l *localResolver) build(key [32]byte, root, target string) error {
+	l.config.debugf("building %s in %s", cmdCue, root)
+	cmd := exec.Command("go", "build", "-o", target, cmdCue)
+	cmd.Dir = root
+	cmd.Env = append(os.Environ(), l.config.bh.buildEnv()...)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("failed to run [%v] in %s: %v\n%s", cmd, root, err, out)
+	}
+	f, err := os.Open(target)
+	if err != nil {
+		return fmt.Errorf("failed to open build result %s: %v", target, err)
+	}
+	defer f.Close()
+	if _, _, err := l.config.bh.cache.Put(key, f); err != nil {
+		return fmt.Errorf("failed to write cue to the cache: %v", err)
+	}
+	return nil
+}
+
+// checkCUEModule verifies that dir is the root of the cuelang.org/go module.
+func checkCUEModule(dir string) error {
+	cmd := exec.Command("go", "list", "-m", "-json")
+	cmd.Dir = dir
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("failed to determine module information via [%v] in %s: %v\n%s", cmd, dir, err, out)
+	}
+	var gomod struct {
+		Path string
+	}
+	if err := json.Unmarshal(out, &gomod); err != nil {
+		return fmt.Errorf("failed to parse module information: %v\n%s", err, out)
+	}
+	if gomod.Path != cueModule {
+		return fmt.Errorf("%s is not a checkout of %s; found module %s", dir, cueModule, gomod.Path)
+	}
+	return nil
+}
+
+// localRevision returns the HEAD commit of the git checkout at root. If the
+// checkout has uncommitted changes, including untracked files that are not
+// ignored, a hash of those changes is appended to the commit.
+func localRevision(root string) (string, error) {
+	commit, err := gitDir(root, "rev-parse", "HEAD")
+	if err != nil {
+		return "", fmt.Errorf("failed to rev-parse HEAD: %v", err)
+	}
+	commit = strings.TrimSpace(commit)
+	diff, err := gitDir(root, "diff", "--binary", "HEAD")
+	if err != nil {
+		return "", fmt.Errorf("failed to diff against HEAD: %v", err)
+	}
+	untracked, err := gitDir(root, "ls-files", "-z", "--others", "--exclude-standard")
+	if err != nil {
+		return "", fmt.Errorf("failed to list untracked files: %v", err)
+	}
+	if diff == "" && untracked == "" {
+		return commit, nil
+	}
+	h := sha256.New()
+	fmt.Fprintf(h, "diff %d\n%s", len(diff), diff)
+	for _, name := range strings.Split(strings.TrimSuffix(untracked, "\x00"), "\x00") {
+		if name == "" {
+			continue
+		}
+		fmt.Fprintf(h, "untracked %s\n", name)
+		f, err := os.Open(filepath.Join(root, name))
+		if err != nil {
+			return "", fmt.Errorf("failed to read untracked file: %v", err)
+		}
+		_, err = io.Copy(h, f)
+		f.Close()
+		if err != nil {
+			return "", fmt.Errorf("failed to read untracked file %s: %v", name, err)
+		}
+	}
+	return fmt.Sprintf("%s+dirty.%x", commit, h.Sum(nil)[:6]), nil
+}
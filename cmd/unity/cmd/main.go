@@ -51,6 +51,9 @@ const (
 func Main() int {
 	cwd, _ := os.Getwd()
 	err := mainErr(context.Background(), os.Args[1:])
+	if err == errDockerTimeout {
+		return exitCodeTimeout
+	}
 	if err != nil {
 		if err != errPrintedError {
 			errors.Print(os.Stderr, err, &errors.Config{
@@ -98,8 +101,14 @@ func newRootCmd() *Command {
 
 	subCommands := []*cobra.Command{
 		newTestCmd(c),
+		newInitCmd(c),
+		newVetCmd(c),
+		newCorpusCmd(c),
+		newMergeResultsCmd(c),
 		newDockerCmd(c),
 		newDockexecCmd(c),
+		newNsexecCmd(c),
+		newSandboxInitCmd(c),
 	}
 	// TODO: add help topics
 
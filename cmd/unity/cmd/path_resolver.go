@@ -15,8 +15,13 @@
 package cmd
 
 import (
+	"debug/buildinfo"
+	"errors"
 	"fmt"
+	"io/fs"
+	"os"
 	"os/exec"
+	"path/filepath"
 )
 
 // pathResolver resolves the CUE version "PATH" to the cue binary that is
@@ -48,8 +53,81 @@ func (p *pathResolver) resolve(version, dir, workingDir, target string) (string,
 	if err != nil {
 		return "", fmt.Errorf("failed to find cue in PATH: %v", err)
 	}
-	// TODO: check GOOS and GOARCH for the result
-	// TODO: extract more useful version information from the cue binary
-	// in PATH
+	// Note that the GOOS and GOARCH of the result are checked, and more
+	// useful version information extracted, by probeCUE.
 	return "PATH", copyExecutableFile(exe, target)
 }
+
+func (p *pathResolver) goModReplace(version, dir, workingDir string) (string, error) {
+	if version != "PATH" {
+		return "", errNoMatch
+	}
+	exe, err := exec.LookPath("cue")
+	if err != nil {
+		return "", fmt.Errorf("failed to find cue in PATH: %v", err)
+	}
+	replace, err := buildInfoReplace(exe)
+	if err != nil {
+		return "", err
+	}
+	if replace == "" {
+		// We don't know where the cue binary in PATH was built from, e.g.
+		// because it was built from a checkout of CUE, so Go tests use the
+		// version of CUE from the project's go.mod
+		fmt.Fprintf(os.Stderr, "warning: Go tests use the version of %s in go.mod, because the source of %s is unknown\n", cueModule, exe)
+	}
+	return replace, nil
+}
+
+// buildInfoReplace returns the replacement for cuelang.org/go corresponding to
+// the version of it that the cue binary exe was built with, according to its
+// build information. It returns the empty string if that is not known, which
+// is the case when exe was built from a checkout of CUE.
+func buildInfoReplace(exe string) (string, error) {
+	bi, err := buildinfo.ReadFile(exe)
+	if err != nil {
+		var pathErr *fs.PathError
+		if errors.As(err, &pathErr) {
+			return "", fmt.Errorf("failed to read build information from %s: %v", exe, err)
+		}
+		// Not a Go binary, or one without build information
+		return "", nil
+	}
+	// cue is either the main package of cuelang.org/go, possibly replaced
+	// by a directory, or was built as part of another main module
+	m := &bi.Main
+	if m.Path != cueModule {
+		m = nil
+		for _, d := range bi.Deps {
+			if d.Path == cueModule {
+				m = d
+			}
+		}
+	}
+	if m == nil {
+		return "", nil
+	}
+	if m.Replace != nil {
+		m = m.Replace
+	}
+	if m.Version != "" && m.Version != "(devel)" {
+		return m.Path + "@" + m.Version, nil
+	}
+	// A directory replacement, which might be relative to a main module that
+	// we know nothing about, or a checkout of CUE, whose directory is not
+	// recorded at all
+	if m.Path == cueModule || !filepath.IsAbs(m.Path) {
+		return "", nil
+	}
+	return m.Path, nil
+}
+
+func (p *pathResolver) check(version string) error {
+	if version != "PATH" {
+		return errNoMatch
+	}
+	if !p.config.allowPATH {
+		return errPATHNotAllowed
+	}
+	return nil
+}
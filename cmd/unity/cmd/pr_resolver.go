@@ -0,0 +1,109 @@
+// Copyright 2023 The CUE Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+const (
+	prVersionPrefix = "pr:"
+
+	cueGitHubSource = "https://github.com/cue-lang/cue"
+)
+
+// prResolver resolves a "pr:$number" or "pr:$number/$commit" reference to a
+// pull request from the CUE GitHub repository. The first form resolves to the
+// current head of the pull request; the second pins a specific commit. The
+// result is stored in the unity user cache directory.
+type prResolver struct {
+	cc *commonCUEResolver
+
+	// source is the git remote from which pull request refs are fetched. It
+	// defaults to cueGitHubSource, but can be overridden via
+	// UNITY_CUE_GITHUB_SOURCE, e.g. to a local bare repository in tests
+	source string
+}
+
+func newPRResolver(c resolverConfig) (resolver, error) {
+	source := os.Getenv("UNITY_CUE_GITHUB_SOURCE")
+	if source == "" {
+		source = cueGitHubSource
+	}
+	res := &prResolver{
+		cc:     c.commonCUEResolver,
+		source: source,
+	}
+	return res, nil
+}
+
+func (p *prResolver) resolve(version, _, working, target string) (string, error) {
+	strategy, err := p.strategy(version)
+	if err != nil {
+		return "", err
+	}
+	return p.cc.resolve(version, working, target, strategy)
+}
+
+func (p *prResolver) goModReplace(version, _, working string) (string, error) {
+	strategy, err := p.strategy(version)
+	if err != nil {
+		return "", err
+	}
+	return p.cc.sourceWorktree(version, working, strategy)
+}
+
+func (p *prResolver) check(version string) error {
+	_, err := p.strategy(version)
+	return err
+}
+
+// strategy returns the strategy for resolving version within the CUE clone.
+func (p *prResolver) strategy(version string) (cueStrategy, error) {
+	if !strings.HasPrefix(version, prVersionPrefix) {
+		return nil, errNoMatch
+	}
+	number, commit, _ := strings.Cut(strings.TrimPrefix(version, prVersionPrefix), "/")
+	if n, err := strconv.ParseUint(number, 10, 64); err != nil || n == 0 {
+		return nil, fmt.Errorf("invalid pull request number in %q", version)
+	}
+	ref := fmt.Sprintf("refs/pull/%s/head", number)
+	return func(c *commonCUEResolver) (string, string, error) {
+		// fetch the pull request head
+		if _, err := gitDir(c.dir, "fetch", p.source, ref); err != nil {
+			return "", "", fmt.Errorf("failed to fetch %s: %v", ref, err)
+		}
+		rev := "FETCH_HEAD"
+		if commit != "" {
+			// The pinned commit might no longer be reachable from the head of
+			// the pull request, e.g. after a force push, so fetch it explicitly
+			// if we don't have it.
+			if _, err := gitDir(c.dir, "cat-file", "-e", commit+"^{commit}"); err != nil {
+				if _, err := gitDir(c.dir, "fetch", p.source, commit); err != nil {
+					return "", "", fmt.Errorf("failed to fetch %s: %v", commit, err)
+				}
+			}
+			rev = commit
+		}
+		sha, err := c.revParse(rev)
+		if err != nil {
+			return "", "", err
+		}
+		return fmt.Sprintf("%s%s/%s", prVersionPrefix, number, sha), sha, nil
+	}, nil
+}
@@ -16,11 +16,11 @@ package cmd
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
 	"io/fs"
-	mathrand "math/rand"
 	"os"
 	"os/exec"
 	"path"
@@ -29,6 +29,7 @@ import (
 	"runtime"
 	"sort"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"cuelang.org/go/cue"
@@ -36,6 +37,7 @@ import (
 	"cuelang.org/go/cue/load"
 	"cuelang.org/go/cue/stats"
 	"github.com/cue-unity/unity"
+	"github.com/cue-unity/unity/internal/scriptparams"
 	"github.com/olekukonko/tablewriter"
 	"github.com/rogpeppe/go-internal/testscript"
 	"github.com/rogpeppe/go-internal/txtar"
@@ -46,7 +48,7 @@ const (
 	// we create a worktree copy of the module under test. The
 	// initial working directory for the CUE module under test is
 	// then $WORK/repo/path/to/mod
-	repoDir = "repo"
+	repoDir = scriptparams.RepoDir
 
 	// packageTests is the name of the package within which we define
 	// the module test manifest and the testscript files
@@ -59,10 +61,25 @@ const (
 
 var (
 	errTestFail = errors.New("tests failed")
+
+	// errTestTimeout indicates that tests did not complete within their
+	// timeout, which we report distinctly from a failure
+	errTestTimeout = errors.New("tests timed out")
+
+	// errTestOOM indicates that the container running tests in safe mode
+	// was killed for exceeding its memory limit, which we report distinctly
+	// from a failure
+	errTestOOM = errors.New("tests ran out of memory")
 )
 
+// isTestFailure reports whether err is the result of tests that failed,
+// timed out or ran out of memory, as opposed to an error running the tests.
+func isTestFailure(err error) bool {
+	return errors.Is(err, errTestFail) || errors.Is(err, errTestTimeout) || errors.Is(err, errTestOOM)
+}
+
 func testProject(cmd *Command, mt *moduleTester, versions []string) error {
-	modules, err := mt.deriveModules(mt.gitRoot)
+	modules, err := mt.deriveModules(mt.gitRoot, "", mt.gitRoot)
 	if err != nil {
 		return fmt.Errorf("failed to derive modules under %s: %v", mt.gitRoot, err)
 	}
@@ -115,20 +132,6 @@ func (mt *moduleTester) test(modules []*module, versions []string) error {
 		// wg.Wait()
 	}
 
-	// Write results to a table
-	tw := tablewriter.NewWriter(os.Stderr)
-	tw.SetAutoWrapText(false)
-	tw.SetAutoFormatHeaders(true)
-	tw.SetHeaderAlignment(tablewriter.ALIGN_LEFT)
-	tw.SetAlignment(tablewriter.ALIGN_LEFT)
-	tw.SetCenterSeparator("")
-	tw.SetColumnSeparator("")
-	tw.SetRowSeparator("")
-	tw.SetHeaderLine(false)
-	tw.SetBorder(false)
-	tw.SetTablePadding("  ")
-	tw.SetNoWhiteSpace(true)
-
 	// The logic on when we allow updates is driven by the versions that may
 	// have been passed as arguments. With no versions supplied as arguments
 	// we allow updating for the base versions of a module (ignoring the
@@ -155,19 +158,63 @@ func (mt *moduleTester) test(modules []*module, versions []string) error {
 		verify(len(versions) == 1, func(*module) []string { return versions })
 	}
 
-	logTime := func(tr *testResult) {
-		status := "ok"
-		if tr.err != nil {
-			status = "FAIL"
+	if mt.resultsFile != "" {
+		if err := writeResults(mt.resultsFile, tested, mt.skipped); err != nil {
+			return err
 		}
+	}
+	if mt.junitFile != "" {
+		if err := writeJUnit(mt.junitFile, tested, mt.skipped); err != nil {
+			return err
+		}
+	}
+	return reportResults(tested, firstResult, mt.skipped, mt.verbose)
+}
+
+// reportResults writes the results of tests to a table on stderr, along with
+// the logs of failed tests, or of all tests if verbose. firstResult maps each
+// module to its first result, against which its other results are compared.
+// Paths of corpus projects in skipped are reported as SKIPPED. It returns
+// errTestFail if any of the tests did not pass.
+func reportResults(tested []*testResult, firstResult map[*module]*testResult, skipped []string, verbose bool) error {
+	// Write results to a table
+	tw := tablewriter.NewWriter(os.Stderr)
+	tw.SetAutoWrapText(false)
+	tw.SetAutoFormatHeaders(true)
+	tw.SetHeaderAlignment(tablewriter.ALIGN_LEFT)
+	tw.SetAlignment(tablewriter.ALIGN_LEFT)
+	tw.SetCenterSeparator("")
+	tw.SetColumnSeparator("")
+	tw.SetRowSeparator("")
+	tw.SetHeaderLine(false)
+	tw.SetBorder(false)
+	tw.SetTablePadding("  ")
+	tw.SetNoWhiteSpace(true)
+
+	sawError := false
+
+	logTime := func(tr *testResult) {
+		status := resultStatus(tr.err)
 		prev := firstResult[tr.module]
 
-		result := []string{status, tr.module.path, tr.resolvedVersion}
+		result := []string{status, tr.module.path, tr.displayVersion()}
 		if prev != tr {
 			result = append(result, fmt.Sprintf("vs %s", prev.resolvedVersion))
 		}
 		tw.Append(result)
 
+		if verbose {
+			overlays := "none"
+			if len(tr.module.overlays) > 0 {
+				overlays = strings.Join(tr.module.overlays, ", ")
+			}
+			tw.Append([]string{"", "Overlays", overlays})
+		}
+
+		for _, r := range tr.goTests {
+			tw.Append([]string{"", "GoTest", fmt.Sprintf("%s %s (%.3fs)", r.status(), r.name(), r.elapsed.Seconds())})
+		}
+
 		// wall time is separate from CUE_STATS_FILE and it's a duration.
 		resultTime := []string{"", "WallTime", fmt.Sprintf("%.3fs", tr.duration.Seconds())}
 		if prev != tr {
@@ -213,23 +260,26 @@ func (mt *moduleTester) test(modules []*module, versions []string) error {
 	// first, then if we had any test failures dump the logs. If
 	// we saw any errors return errTestFail
 	for _, tr := range tested {
-		if tr.err != nil && !errors.Is(tr.err, errTestFail) {
+		if tr.err != nil && !isTestFailure(tr.err) {
 			sawError = true
 			fmt.Fprintln(os.Stderr, tr.err)
 		}
 	}
 	out := os.Stderr
-	if mt.verbose {
+	if verbose {
 		out = os.Stdout
 	}
 	for _, tr := range tested {
-		hasErr := tr.err != nil && errors.Is(tr.err, errTestFail)
+		hasErr := tr.err != nil && isTestFailure(tr.err)
 		sawError = sawError || hasErr
-		if hasErr || mt.verbose {
+		if hasErr || verbose {
 			fmt.Fprint(out, tr.log.String())
 		}
 		logTime(tr)
 	}
+	for _, p := range skipped {
+		tw.Append([]string{"SKIPPED", p, "not initialised"})
+	}
 	tw.Render()
 	if sawError {
 		return errTestFail
@@ -237,6 +287,20 @@ func (mt *moduleTester) test(modules []*module, versions []string) error {
 	return nil
 }
 
+// resultStatus returns the status of a test result with error err, as
+// reported in the results table.
+func resultStatus(err error) string {
+	switch {
+	case err == nil:
+		return "ok"
+	case errors.Is(err, errTestTimeout):
+		return "TIMEOUT"
+	case errors.Is(err, errTestOOM):
+		return "OOM"
+	}
+	return "FAIL"
+}
+
 type testResult struct {
 	module          *module
 	version         string
@@ -245,10 +309,46 @@ type testResult struct {
 	err             error
 	duration        time.Duration
 
+	// cueBuildInfo is the build information probed from the
+	// resolved cue binary
+	cueBuildInfo *cueBuildInfo
+
+	// goTests are the results of the Go tests of the module
+	goTests []goTestResult
+
+	// scripts are the results of the test scripts of the module
+	scripts []scriptResult
+
 	cueStatsCount int
 	cueStatsTotal stats.Counts
 }
 
+// scriptResult is the result of a single test script.
+type scriptResult struct {
+	name string
+
+	// status is the status of the script as it is logged: PASS, FAIL, SKIP
+	// or TIMEOUT
+	status string
+
+	elapsed time.Duration
+
+	// output is the log of the script, which is only kept for the scripts
+	// that are logged: failed scripts, or all scripts if verbose
+	output string
+}
+
+// displayVersion returns the version tested by tr as it is reported, which
+// is the resolved version along with the build information of the cue binary,
+// if any. The build information tells us what version was really tested,
+// regardless of how it was specified, e.g. PATH.
+func (tr *testResult) displayVersion() string {
+	if tr.cueBuildInfo == nil {
+		return tr.resolvedVersion
+	}
+	return fmt.Sprintf("%s [%s]", tr.resolvedVersion, tr.cueBuildInfo)
+}
+
 var cueEvaluatorStatsFields = reflect.VisibleFields(reflect.TypeOf(stats.Counts{}))
 
 type moduleTester struct {
@@ -283,9 +383,21 @@ type moduleTester struct {
 	// be searched for CUE modules.
 	gitRoot string
 
-	// overlayDir is a directory that might contain overlays for a
-	// given module.
-	overlayDir string
+	// overlayDirs are the directories that might contain overlays for a
+	// given module, in increasing order of precedence.
+	overlayDirs []string
+
+	// resultsFile is the path of a file to which the results of tests are
+	// written as JSON, or empty
+	resultsFile string
+
+	// junitFile is the path of a file to which the results of tests are
+	// written as a JUnit XML report, or empty
+	junitFile string
+
+	// skipped are the paths of the git submodules of a corpus that are not
+	// tested because they are not initialised. They are reported as SKIPPED.
+	skipped []string
 
 	verbose bool
 
@@ -314,6 +426,25 @@ type moduleTester struct {
 
 	// skipBase indicates we should skip testing base versions for a project
 	skipBase bool
+
+	// scriptTimeout is the time after which a test script fails
+	scriptTimeout time.Duration
+
+	// parallel is the maximum number of test scripts of a module that run
+	// in parallel
+	parallel int
+
+	// goTestScripts indicates that test scripts should be run via go test
+	// in a temporary module, as opposed to in-process or via unity docker
+	goTestScripts bool
+
+	// limits are the resource limits of containers in safe mode. Network
+	// access is enabled per module via the manifest.
+	limits containerLimits
+
+	// sandbox is the sandbox used in safe mode: sandboxDocker or
+	// sandboxNamespace
+	sandbox string
 }
 
 func newModuleTester(mt moduleTester) (*moduleTester, error) {
@@ -356,17 +487,22 @@ func (mt *moduleTester) tempDir(name string) (string, error) {
 }
 
 // newInstance creates a module instances rooted in the CUE module that is dir.
-// A precondition of this function is that dir must be contained in gitRoot.
-func (mt *moduleTester) newInstance(gitRoot, dir string) (*module, error) {
+// A precondition of this function is that dir must be contained in gitRoot,
+// and gitRoot in testerRoot. testerRoot is usually mt.gitRoot, but corpus
+// projects declared in a corpus file are checked out elsewhere. The module
+// path relative to testerRoot locates its overlays within mt.overlayDirs.
+// projOverlay, if not empty, is the overlay directory of the project at
+// gitRoot, which takes precedence over mt.overlayDirs.
+func (mt *moduleTester) newInstance(testerRoot, projOverlay, gitRoot, dir string) (*module, error) {
 	mod := load.Instances([]string{"."}, &load.Config{Dir: dir})[0]
 	if mod.Module == "" {
 		return nil, fmt.Errorf("could not find main CUE module root")
 	}
 
 	// We know that dir is contained within gitRoot. Furthermore, that gitRoot is
-	// contained within mt.gitRoot. Store the relative paths on the resulting
+	// contained within testerRoot. Store the relative paths on the resulting
 	// module for convenience
-	testerGitRel := dir[len(mt.gitRoot):]
+	testerGitRel := dir[len(testerRoot):]
 	if strings.HasPrefix(testerGitRel, string(os.PathSeparator)) {
 		testerGitRel = strings.TrimPrefix(testerGitRel, string(os.PathSeparator))
 	}
@@ -382,72 +518,267 @@ func (mt *moduleTester) newInstance(gitRoot, dir string) (*module, error) {
 	}
 
 	// Verify this is a valid module by loading the manifest
-	manifestDir := filepath.Join(mod.Root, "cue.mod", packageTests)
-	// Now see if there is an overlay for this path
-	// Only if the tests directory exists do we attempt to
-	// create a module instance
-	if mt.overlayDir != "" {
-		overlayDir := filepath.Join(mt.overlayDir, testerGitRel)
-		if fi, err := os.Stat(overlayDir); err == nil && fi.IsDir() {
-			manifestDir = overlayDir
-		}
-	}
-	manifestInst := load.Instances([]string{"."}, &load.Config{
-		Dir: manifestDir,
-	})
-	manifestInput := mt.runtime.BuildInstance(manifestInst[0])
-	if err := manifestInput.Err(); err != nil {
-		return nil, fmt.Errorf("failed to load tests manifest from %s: %v", manifestDir, err)
+	layers, overlays := mt.manifestLayers(mod.Root, testerGitRel, projOverlay, gitRel)
+	manifest, err := mt.loadValidManifest(layers)
+	if err != nil {
+		return nil, err
+	}
+	timeout, scriptTimeouts, err := manifestTimeouts(manifest)
+	if err != nil {
+		return nil, err
+	}
+	if mt.goTestScripts && len(scriptTimeouts) > 0 {
+		// go test only has a timeout for the whole test binary
+		return nil, fmt.Errorf("ScriptTimeouts are not supported with --%s", flagTestGoTest)
+	}
+
+	// Pre-validate that none of the testscript files we are going to validate
+	// have a module/ path in their archive
+	sources, err := layerScripts(layers)
+	if err != nil {
+		return nil, err
+	}
+	for _, s := range sources {
+		archive, err := txtar.ParseFile(s)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse txtar archive %s: %v", s, err)
+		}
+		if invalid := repoPaths(archive); len(invalid) > 0 {
+			return nil, fmt.Errorf("%s contains invalid file path %s", s, invalid[0])
+		}
+	}
+
+	// The scripts of a single layer are run in place. Otherwise they are
+	// merged into a directory of their own
+	manifestDir := layers[0]
+	scripts := sources
+	var scriptSources map[string]string
+	if len(layers) > 1 {
+		manifestDir, err = mt.tempDir("manifest")
+		if err != nil {
+			return nil, fmt.Errorf("failed to create merged manifest directory: %v", err)
+		}
+		scripts = nil
+		scriptSources = make(map[string]string)
+		for _, src := range sources {
+			dst := filepath.Join(manifestDir, filepath.Base(src))
+			if err := copyFile(dst, src); err != nil {
+				return nil, err
+			}
+			scripts = append(scripts, dst)
+			scriptSources[dst] = src
+		}
+	}
+
+	res := &module{
+		path:           mod.Module,
+		tester:         mt,
+		gitRoot:        gitRoot,
+		root:           mod.Root,
+		testerRelPath:  testerGitRel,
+		relPath:        gitRel,
+		manifestDir:    manifestDir,
+		scripts:        scripts,
+		scriptSources:  scriptSources,
+		overlays:       overlays,
+		manifest:       manifest,
+		timeout:        timeout,
+		scriptTimeouts: scriptTimeouts,
+		hasStaged:      hasStaged,
+	}
+	return res, nil
+}
+
+// manifestLayers returns the directories from which the tests manifest and
+// scripts of the module at root are layered, in increasing order of
+// precedence, along with the overlays among them. testerRel is the path of
+// root relative to mt.gitRoot, and gitRel its path relative to the root of
+// the project whose overlay directory is projOverlay, if not empty.
+func (mt *moduleTester) manifestLayers(root, testerRel, projOverlay, gitRel string) (layers, overlays []string) {
+	testsDir := filepath.Join(root, "cue.mod", packageTests)
+	if fi, err := os.Stat(testsDir); err == nil && fi.IsDir() {
+		layers = append(layers, testsDir)
+	}
+	// Each overlay, in increasing order of precedence, is layered on top of
+	// the module's own tests, unless it replaces them and any overlays
+	// before it
+	overlays = mt.overlaysOf(testerRel)
+	if projOverlay != "" {
+		dir := filepath.Join(projOverlay, gitRel)
+		if fi, err := os.Stat(dir); err == nil && fi.IsDir() {
+			overlays = append(overlays, dir)
+		}
+	}
+	for _, dir := range overlays {
+		if _, err := os.Stat(filepath.Join(dir, overlayReplaceFile)); err == nil {
+			layers = nil
+		}
+		layers = append(layers, dir)
+	}
+	if len(layers) == 0 {
+		// Loading the manifest fails with a helpful error
+		layers = append(layers, testsDir)
+	}
+	return layers, overlays
+}
+
+// loadValidManifest loads the tests manifest layered from layers, and
+// validates it against the #Manifest definition.
+func (mt *moduleTester) loadValidManifest(layers []string) (unity.Manifest, error) {
+	var manifest unity.Manifest
+	manifestVal, err := mt.loadManifest(layers)
+	if err != nil {
+		return manifest, err
 	}
 
 	// Validate against the embedded #Manifest definition
-	manifestVal := mt.manifestDef.Unify(manifestInput.Value())
+	manifestVal = mt.manifestDef.Unify(manifestVal)
 	if err := manifestVal.Validate(cue.Concrete(true)); err != nil {
-		return nil, fmt.Errorf("failed to validate tests manifest: %v", err)
+		return manifest, fmt.Errorf("failed to validate tests manifest: %v", err)
 	}
-	var manifest unity.Manifest
 	if err := manifestVal.Decode(&manifest); err != nil {
-		return nil, fmt.Errorf("failed to decode manifest: %v", err)
+		return manifest, fmt.Errorf("failed to decode manifest: %v", err)
 	}
+	return manifest, nil
+}
 
-	// Pre-validate that none of the testscript files we are going to validate
-	// have a module/ path in their archive
-	var scripts []string
-	for _, glob := range []string{"*.txtar", "*.txt"} {
-		matches, err := filepath.Glob(filepath.Join(manifestDir, glob))
+// manifestTimeouts parses the Timeout and ScriptTimeouts of manifest.
+func manifestTimeouts(manifest unity.Manifest) (timeout time.Duration, scriptTimeouts map[string]time.Duration, err error) {
+	if manifest.Timeout != "" {
+		timeout, err = time.ParseDuration(manifest.Timeout)
 		if err != nil {
-			return nil, fmt.Errorf("failed to glob for input scripts: %v", err)
+			return 0, nil, fmt.Errorf("invalid Timeout in tests manifest: %v", err)
 		}
-		scripts = append(scripts, matches...)
 	}
-	for _, s := range scripts {
-		archive, err := txtar.ParseFile(s)
+	scriptTimeouts = make(map[string]time.Duration)
+	for name, t := range manifest.ScriptTimeouts {
+		d, err := time.ParseDuration(t)
 		if err != nil {
-			return nil, fmt.Errorf("failed to parse txtar archive %s: %v", s, err)
+			return 0, nil, fmt.Errorf("invalid timeout for script %s in tests manifest: %v", name, err)
+		}
+		scriptTimeouts[name] = d
+	}
+	return timeout, scriptTimeouts, nil
+}
+
+// repoPaths returns the names of the files of archive that are within
+// repoDir, which is reserved for the copy of the repository under test.
+func repoPaths(archive *txtar.Archive) []string {
+	var res []string
+	for _, f := range archive.Files {
+		p := path.Clean(f.Name)
+		if p == repoDir || strings.Split(p, "/")[0] == repoDir {
+			res = append(res, f.Name)
+		}
+	}
+	return res
+}
+
+// overlaysOf returns the overlays of the module at the path rel, relative to
+// mt.gitRoot, within mt.overlayDirs, in increasing order of precedence.
+func (mt *moduleTester) overlaysOf(rel string) []string {
+	var res []string
+	for _, d := range mt.overlayDirs {
+		dir := filepath.Join(d, rel)
+		if fi, err := os.Stat(dir); err == nil && fi.IsDir() {
+			res = append(res, dir)
+		}
+	}
+	return res
+}
+
+// overlayReplaceFile is the name of a file that, when present in an overlay,
+// makes the overlay replace the module's own tests manifest and scripts
+// rather than being merged with them.
+const overlayReplaceFile = "REPLACE"
+
+// loadManifest loads the tests manifest from the CUE package of each of
+// layers, which are in increasing order of precedence. The top-level fields
+// of a layer replace the same fields of the layers before it, such that an
+// overlay can override only Versions of a module's own manifest. Layers
+// without CUE files only contribute scripts.
+func (mt *moduleTester) loadManifest(layers []string) (cue.Value, error) {
+	var res cue.Value
+	loaded := false
+	for i, dir := range layers {
+		cueFiles, err := filepath.Glob(filepath.Join(dir, "*.cue"))
+		if err != nil {
+			return cue.Value{}, fmt.Errorf("failed to glob for manifest files: %v", err)
+		}
+		if len(cueFiles) == 0 && (loaded || i < len(layers)-1) {
+			continue
 		}
-		for _, f := range archive.Files {
-			p := path.Clean(f.Name)
-			if p == repoDir || strings.Split(p, "/")[0] == repoDir {
-				return nil, fmt.Errorf("%s contains invalid file path %s", s, f.Name)
+		inst := load.Instances([]string{"."}, &load.Config{
+			Dir: dir,
+		})
+		v := mt.runtime.BuildInstance(inst[0])
+		if err := v.Err(); err != nil {
+			return cue.Value{}, fmt.Errorf("failed to load tests manifest from %s: %v", dir, err)
+		}
+		if loaded {
+			iter, err := res.Fields()
+			if err != nil {
+				return cue.Value{}, fmt.Errorf("failed to read tests manifest fields: %v", err)
+			}
+			for iter.Next() {
+				p := cue.MakePath(iter.Selector())
+				if !v.LookupPath(p).Exists() {
+					v = v.FillPath(p, iter.Value())
+				}
 			}
 		}
+		res = v
+		loaded = true
 	}
+	return res, nil
+}
 
-	res := &module{
-		path:          mod.Module,
-		tester:        mt,
-		gitRoot:       gitRoot,
-		root:          mod.Root,
-		testerRelPath: testerGitRel,
-		relPath:       gitRel,
-		manifestDir:   manifestDir,
-		scripts:       scripts,
-		manifest:      manifest,
-		hasStaged:     hasStaged,
+// layerScripts returns the test scripts of layers, which are in increasing
+// order of precedence. A script shadows any script of the same name, ignoring
+// its extension, in the layers before it. Two scripts of the same name in the
+// same layer are an error.
+func layerScripts(layers []string) ([]string, error) {
+	var names []string
+	byName := make(map[string]string)
+	for _, dir := range layers {
+		inLayer := make(map[string]string)
+		for _, glob := range []string{"*.txtar", "*.txt"} {
+			matches, err := filepath.Glob(filepath.Join(dir, glob))
+			if err != nil {
+				return nil, fmt.Errorf("failed to glob for input scripts: %v", err)
+			}
+			for _, m := range matches {
+				name := strings.TrimSuffix(strings.TrimSuffix(filepath.Base(m), ".txtar"), ".txt")
+				if other, ok := inLayer[name]; ok {
+					return nil, fmt.Errorf("test scripts %s and %s in %s have the same name", filepath.Base(other), filepath.Base(m), dir)
+				}
+				inLayer[name] = m
+				if _, ok := byName[name]; !ok {
+					names = append(names, name)
+				}
+				byName[name] = m
+			}
+		}
+	}
+	var res []string
+	for _, n := range names {
+		res = append(res, byName[n])
 	}
 	return res, nil
 }
 
+// copyFile copies the contents of the file src to dst.
+func copyFile(dst, src string) error {
+	data, err := os.ReadFile(src)
+	if err != nil {
+		return fmt.Errorf("failed to read %s: %v", src, err)
+	}
+	if err := os.WriteFile(dst, data, 0666); err != nil {
+		return fmt.Errorf("failed to write %s: %v", dst, err)
+	}
+	return nil
+}
+
 // verifyGitStatus ensures that the working tree in dir is valid according to
 // the configuration of mt. It returns hasStaged to indicate if there are
 // staged changes.
@@ -484,7 +815,27 @@ func (mt *moduleTester) verifyGitStatus(dir string) (hasStaged bool, err error)
 	return
 }
 
-func (mt *moduleTester) deriveModules(dir string) (modules []*module, err error) {
+// deriveModules creates module instances for the CUE modules found within the
+// git root dir. testerRoot and projOverlay are as documented on newInstance.
+func (mt *moduleTester) deriveModules(testerRoot, projOverlay, dir string) (modules []*module, err error) {
+	roots, err := findModuleRoots(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, modDir := range roots {
+		m, err := mt.newInstance(testerRoot, projOverlay, dir, modDir)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create module instance at %s: %v", modDir, err)
+		}
+		modules = append(modules, m)
+	}
+	return modules, nil
+}
+
+// findModuleRoots returns the roots of the CUE modules found within dir, that
+// is the directories that contain a cue.mod directory. Directories whose names
+// start with . or _ are skipped.
+func findModuleRoots(dir string) (roots []string, err error) {
 	err = filepath.Walk(dir, func(path string, info fs.FileInfo, err error) error {
 		if err != nil {
 			return err
@@ -498,12 +849,7 @@ func (mt *moduleTester) deriveModules(dir string) (modules []*module, err error)
 		if !info.IsDir() {
 			return fmt.Errorf("%s is not a directory", path)
 		}
-		modDir := filepath.Dir(path)
-		m, err := mt.newInstance(dir, modDir)
-		if err != nil {
-			return fmt.Errorf("failed to create module instance at %s: %v", modDir, err)
-		}
-		modules = append(modules, m)
+		roots = append(roots, filepath.Dir(path))
 		// Do not recurse within the cue.mod - otherwise we might find modules
 		// in the vendor
 		return filepath.SkipDir
@@ -540,9 +886,24 @@ type module struct {
 	// as testscript tests for this module
 	scripts []string
 
+	// scriptSources maps each of scripts to the file from which it was
+	// copied, if the scripts were merged from a module's own tests and its
+	// overlay. Updates to scripts are written back to their sources.
+	scriptSources map[string]string
+
+	// overlays are the overlay directories that apply to the module, in
+	// increasing order of precedence
+	overlays []string
+
 	// manifest is the decoded manifest for the module
 	manifest unity.Manifest
 
+	// timeout is the parsed manifest Timeout, or zero for no timeout
+	timeout time.Duration
+
+	// scriptTimeouts are the parsed manifest ScriptTimeouts
+	scriptTimeouts map[string]time.Duration
+
 	// tester is the moduleTester instance that created
 	// this module instance
 	tester *moduleTester
@@ -552,6 +913,10 @@ type module struct {
 	hasStaged bool
 }
 
+// dockerKillGrace is the time we allow unity docker beyond the module timeout
+// to report that the module timed out, before we kill its container.
+const dockerKillGrace = 10 * time.Second
+
 // cueStatsSubdir is a subdirectory inside workdirRoot where cmd/cue writes
 // CUE_STATS_FILE JSON files.
 const cueStatsSubdir = "cue-evaluator-stats"
@@ -569,11 +934,22 @@ func (mt *moduleTester) run(tr *testResult, allowUpdate bool) (err error) {
 	if err := os.Mkdir(filepath.Dir(cuePath), 0777); err != nil {
 		return fmt.Errorf("failed to create cue bin directory for %q: %v", cuePath, err)
 	}
-	tr.resolvedVersion, err = m.tester.versionResolver.resolve(version, m.root, working, cuePath)
+	// The version might carry environment settings that describe a variant of
+	// a CUE version, which is then a distinct version for the purposes of
+	// results and comparisons
+	base, env := parseVersionEnv(version)
+	tr.resolvedVersion, err = m.tester.versionResolver.resolve(base, m.root, working, cuePath)
+	if err != nil {
+		return err
+	}
+	if len(env) > 0 {
+		tr.resolvedVersion += "+" + strings.Join(env, "+")
+	}
+	tr.cueBuildInfo, err = mt.buildHelper.probeCUE(cuePath)
 	if err != nil {
 		return err
 	}
-	fmt.Fprintf(os.Stderr, "testing %s against version %s\n", tr.module.path, tr.resolvedVersion)
+	fmt.Fprintf(os.Stderr, "testing %s against version %s\n", tr.module.path, tr.displayVersion())
 	// Create a pristine copy of the git root with no history
 	td, err := mt.tempDir("workdir")
 	if err != nil {
@@ -616,23 +992,67 @@ func (mt *moduleTester) run(tr *testResult, allowUpdate bool) (err error) {
 		}
 	}
 
+	limits := mt.limits
+	limits.network = m.manifest.Network
 	rmi := runModuleInfo{
-		self:          mt.self,
-		manifestDir:   m.manifestDir,
-		workdirRoot:   td,
-		relPath:       m.relPath,
-		testerRelPath: m.testerRelPath,
-		cuePath:       cuePath,
-		version:       version,
-		goTests:       m.manifest.GoTests,
-		update:        allowUpdate && mt.update,
-		verbose:       mt.verbose,
+		self:           mt.self,
+		manifestDir:    m.manifestDir,
+		workdirRoot:    td,
+		relPath:        m.relPath,
+		testerRelPath:  m.testerRelPath,
+		cuePath:        cuePath,
+		version:        version,
+		env:            env,
+		goTests:        m.manifest.GoTests,
+		parallel:       mt.parallel,
+		scriptTimeout:  mt.scriptTimeout,
+		timeout:        m.timeout,
+		scriptTimeouts: m.scriptTimeouts,
+		limits:         limits,
+		update:         allowUpdate && mt.update,
+		verbose:        mt.verbose,
 	}
 	statsDir := filepath.Join(rmi.workdirRoot, cueStatsSubdir)
 	if err := os.MkdirAll(statsDir, 0o777); err != nil {
 		return fmt.Errorf("failed to create cue-stats dir: %v", err)
 	}
 
+	// Run Go tests against the CUE version under test. We do this before
+	// starting the clock, because go mod tidy might need to download modules.
+	if len(rmi.goTests) > 0 {
+		if err := mt.replaceCUE(filepath.Join(rmi.workdirRoot, goTestsDir), base, m.root, working); err != nil {
+			return err
+		}
+	}
+
+	// Likewise, generating the module that runs test scripts via go test
+	// might need to download go-internal
+	scriptsModule := filepath.Join(working, scriptsModuleDir)
+	if mt.goTestScripts {
+		if err := mt.writeScriptsModule(scriptsModule, rmi); err != nil {
+			return err
+		}
+	}
+
+	if rmi.update && len(m.scriptSources) > 0 {
+		// Updates are made to the merged scripts, so write them back to the
+		// scripts from which they were merged
+		defer func() {
+			for dst, src := range m.scriptSources {
+				updated, err1 := os.ReadFile(dst)
+				if err1 == nil {
+					var orig []byte
+					if orig, err1 = os.ReadFile(src); err1 == nil && !bytes.Equal(orig, updated) {
+						err1 = os.WriteFile(src, updated, 0666)
+					}
+				}
+				if err1 != nil && err == nil {
+					err = fmt.Errorf("failed to write back updated script %s: %v", src, err1)
+				}
+			}
+		}()
+	}
+
 	start := time.Now()
 	defer func() {
 		tr.duration = time.Since(start)
@@ -641,25 +1061,25 @@ func (mt *moduleTester) run(tr *testResult, allowUpdate bool) (err error) {
 		}
 	}()
 
-	// TODO(mvdan): consider a single `go test` invocation, since we could then
-	// pass the -run flag via -exec.
-	// We could similarly run the test scripts via `go test` and a temporary
-	// module requiring go-internal and containing just a tmp_test.go.
-	// Then, we could test everything with at most two `go test` invocations,
-	// and those would also handle concurrency for us via `go test -p`.
+	// The module timeout applies to Go tests and scripts alike
+	ctx := context.Background()
+	if rmi.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, rmi.timeout)
+		defer cancel()
+	}
 
-	// TODO(mvdan): edit the CUE version in go.mod per rmi.version.
-	// Probably use `go mod edit -replace` followed by `go mod tidy`,
-	// to ensure that we don't attempt to fight MVS with downgrades.
+	// TODO: make goTestScripts the default once it has proven itself,
+	// such that we test everything with at most two `go test` invocations.
 
 	// TODO(mvdan): use the Go version specified by GoVersion in tests.cue.
 	// or even better, use the version from the `toolchain` line per
 	// https://github.com/golang/go/discussions/55092
 	// Remember to check whether `go1.19.1 download` is safe for concurrent use.
 
-	// TODO(mvdan): we should have a test that ensures that safe mode actually
-	// works, by e.g. trying to peek at the host machine.
-	for pkgPattern, testFlags := range rmi.goTests {
+	// Note that test_project_sandbox_escape verifies that safe mode isolates
+	// Go tests from the host.
+	for _, g := range goTestGroups(rmi.goTests) {
 		testArgs := []string{"test",
 			// We don't need nor want to run vet.
 			"-vet=off",
@@ -669,18 +1089,43 @@ func (mt *moduleTester) run(tr *testResult, allowUpdate bool) (err error) {
 			// but also to prevent unintended test cache hits,
 			// such as if the Docker image behind a tag changes.
 			"-count=1",
+
+			// Report the result of each test, such that we know which of
+			// them failed. Note that this implies verbose test output.
+			"-json",
 		}
-		for _, pattern := range testFlags.Run {
-			testArgs = append(testArgs, "-run="+pattern)
-		}
-		if !mt.unsafe {
-			testArgs = append(testArgs, fmt.Sprintf("-exec=%s dockexec %s", mt.self, dockerImageDefault))
-		}
-		if rmi.verbose {
-			testArgs = append(testArgs, "-v")
+		testArgs = append(testArgs, g.args...)
+		if !mt.unsafe && mt.sandbox == sandboxNamespace {
+			// The test binaries need the worktree copy in which they run
+			flag, err := nsexecFlag(mt.self, sandbox{
+				rw:      []string{rmi.workdirRoot},
+				env:     append(append([]string(nil), rmi.env...), g.env...),
+				network: rmi.limits.network,
+			})
+			if err != nil {
+				return err
+			}
+			testArgs = append(testArgs, flag)
+		} else if !mt.unsafe {
+			// The environment settings of the version need to be passed
+			// through to the container as docker flags, along with the
+			// resource limits
+			execArgs := []string{mt.self, "dockexec", dockerImageDefault}
+			execArgs = append(execArgs, rmi.limits.dockerFlags()...)
+			if env := append(append([]string(nil), rmi.env...), g.env...); len(env) > 0 {
+				execArgs = append(execArgs, envFlag(env))
+			}
+			flag, err := execFlag(execArgs...)
+			if err != nil {
+				return err
+			}
+			testArgs = append(testArgs, flag)
 		}
-		testArgs = append(testArgs, pkgPattern)
-		cmd := exec.Command("go", testArgs...)
+		testArgs = append(testArgs, g.patterns...)
+		cmd := exec.CommandContext(ctx, "go", testArgs...)
+		// Test binaries might outlive go test when it is killed, so don't
+		// wait for them to close our pipes
+		cmd.WaitDelay = time.Second
 
 		// Run `go test` inside the goTestsDir worktree copy.
 		cmd.Dir = filepath.Join(rmi.workdirRoot, goTestsDir)
@@ -688,26 +1133,95 @@ func (mt *moduleTester) run(tr *testResult, allowUpdate bool) (err error) {
 		cmd.Env = os.Environ()
 		if !mt.unsafe {
 			cmd.Env = append(cmd.Env, mt.buildHelper.buildEnv()...)
+			if g.race {
+				// The race detector requires cgo, for which we would need
+				// a C cross-compiler when the target differs from the host
+				if mt.buildHelper.crossBuilding() {
+					return fmt.Errorf("cannot use Race when building Go tests for %s/%s", mt.buildHelper.targetGOOS, mt.buildHelper.targetGOARCH)
+				}
+				cmd.Env = append(cmd.Env, "CGO_ENABLED=1")
+			}
 		}
+		cmd.Env = append(cmd.Env, rmi.env...)
+		cmd.Env = append(cmd.Env, g.env...)
 
-		cmd.Stdout = tr.log
-		cmd.Stderr = tr.log
+		stdout, err := cmd.StdoutPipe()
+		if err != nil {
+			return err
+		}
+		// Buffer stderr separately, because it is written concurrently with
+		// our parsing of stdout. It contains errors such as build failures.
+		var stderr bytes.Buffer
+		cmd.Stderr = &stderr
 		if err := cmd.Start(); err != nil {
 			return err
 		}
-		if err := cmd.Wait(); err != nil {
+		results, parseErr := parseGoTestJSON(stdout, tr.log)
+		// Don't leave go test blocked on output that we failed to parse
+		io.Copy(tr.log, stdout)
+		tr.goTests = append(tr.goTests, results...)
+		err = cmd.Wait()
+		tr.log.Write(stderr.Bytes())
+		if ctx.Err() != nil {
+			return errTestTimeout
+		}
+		for _, r := range results {
+			if r.action == "oom" {
+				return errTestOOM
+			}
+		}
+		if err != nil {
 			var exitError *exec.ExitError
 			if errors.As(err, &exitError) {
 				return errTestFail
 			}
 			return err
 		}
+		if parseErr != nil {
+			return parseErr
+		}
 	}
 
-	if mt.unsafe {
-		return runModule(tr.log, rmi)
+	// The scripts get whatever time is left
+	if deadline, ok := ctx.Deadline(); ok {
+		rmi.timeout = time.Until(deadline)
 	}
-	return dockerRunModule(mt.image, tr.log, rmi)
+	switch {
+	case mt.goTestScripts:
+		tr.scripts, err = mt.goTestRunModule(ctx, tr.log, rmi, scriptsModule)
+	case mt.unsafe:
+		tr.scripts, err = runModule(tr.log, rmi)
+	case mt.sandbox == sandboxNamespace:
+		tr.scripts, err = sandboxRunModule(tr.log, rmi)
+	default:
+		tr.scripts, err = dockerRunModule(mt.image, tr.log, rmi)
+	}
+	return err
+}
+
+// replaceCUE rewrites the go.mod in the Go tests worktree copy dir such that
+// cuelang.org/go is the source of the CUE version under test, as opposed to
+// the version the project requires. We use a replace directive followed by
+// go mod tidy, to ensure that we don't attempt to fight MVS with downgrades.
+func (mt *moduleTester) replaceCUE(dir, version, modRoot, working string) error {
+	replace, err := mt.versionResolver.goModReplace(version, modRoot, working)
+	if err != nil {
+		return fmt.Errorf("failed to resolve %s source for %s: %v", cueModule, version, err)
+	}
+	if replace == "" {
+		return nil
+	}
+	for _, args := range [][]string{
+		{"mod", "edit", "-replace", cueModule + "=" + replace},
+		{"mod", "tidy"},
+	} {
+		cmd := exec.Command("go", args...)
+		cmd.Dir = dir
+		if out, err := cmd.CombinedOutput(); err != nil {
+			return fmt.Errorf("failed to run [%v] in %s: %v\n%s", cmd, dir, err, out)
+		}
+	}
+	return nil
 }
 
 // collectCueStats loads and adds up any number of CUE_STATS_FILE json files
@@ -741,122 +1255,247 @@ type runModuleInfo struct {
 	testerRelPath string
 	cuePath       string
 	version       string
+	env           []string
 	goTests       map[string]unity.GoTestFlags
-	update        bool
-	verbose       bool
+	parallel      int
+	scriptTimeout time.Duration
+
+	// timeout is the time after which testing the module times out, or zero
+	// for no timeout. scriptTimeouts override scriptTimeout for individual
+	// scripts.
+	timeout        time.Duration
+	scriptTimeouts map[string]time.Duration
+
+	// limits are the resource limits of the container in which
+	// dockerRunModule runs the scripts
+	limits  containerLimits
+	update  bool
+	verbose bool
 }
 
-func runModule(log io.Writer, info runModuleInfo) (err error) {
-	statsDir := filepath.Join(info.workdirRoot, cueStatsSubdir)
-	params := testscript.Params{
-		UpdateScripts: info.update,
-		// TODO(mvdan): Consider using RequireExplicitExec in the future.
-		Dir:         info.manifestDir,
+// scriptConfig returns the configuration with which the test scripts of
+// info are run, in process or via go test.
+func (info runModuleInfo) scriptConfig() scriptparams.Config {
+	return scriptparams.Config{
+		ManifestDir: info.manifestDir,
 		WorkdirRoot: info.workdirRoot,
-		Setup: func(env *testscript.Env) error {
-			// Limit concurrency across all testscript runs
-			// e.Defer(m.tester.limit())
-
-			// Ensure that cue is on the PATH
-			newPath := filepath.Dir(info.cuePath) + string(os.PathListSeparator) + env.Getenv("PATH")
-			env.Setenv("PATH", newPath)
+		RelPath:     info.relPath,
+		CUEPath:     info.cuePath,
+		StatsDir:    filepath.Join(info.workdirRoot, cueStatsSubdir),
+		Update:      info.update,
+		Env:         info.env,
+	}
+}
 
-			// Set the working directory to be module
-			env.Cd = filepath.Join(env.WorkDir, repoDir, info.relPath)
-			return nil
-		},
-		// TODO(mvdan): We should transition to `exec cue`, which has multiple
-		// advantages over a plain command.
-		Cmds: map[string]func(ts *testscript.TestScript, neg bool, args []string){
-			"cue": buildCmdCUE(info.cuePath, statsDir),
-		},
-	}
-	// TODO: improve logging/printing/errors when we make things concurrent
+// runModule runs the test scripts of info in process, logging failed scripts,
+// or all scripts if info.verbose, to log. It returns the result of each
+// script that ran.
+func runModule(log io.Writer, info runModuleInfo) (scripts []scriptResult, err error) {
+	params := info.scriptConfig().Params()
 	r := newRunT("", nil, info.verbose)
-	func() {
-		defer func() {
-			switch recover() {
-			case nil, skipRun, failedRun:
-				// normal operation
-			default:
-				panic(err)
-			}
+	if info.parallel > 0 {
+		r.limit = make(chan struct{}, info.parallel)
+	}
+	r.timeout = info.scriptTimeout
+	r.timeouts = info.scriptTimeouts
+	if info.timeout > 0 {
+		params.Deadline = testscriptDeadline(info.timeout)
+	}
+	// Run the scripts in a goroutine such that we can stop waiting for them
+	// when the module times out. Any unexpected panic is sent back to us via
+	// done, to be raised in this goroutine.
+	done := make(chan interface{}, 1)
+	go func() {
+		var panicked interface{}
+		defer func() { done <- panicked }()
+		func() {
+			defer func() {
+				switch p := recover(); p {
+				case nil, skipRun, failedRun:
+					// normal operation
+				default:
+					panicked = p
+				}
+			}()
+			testscript.RunT(r, params)
 		}()
-		testscript.RunT(r, params)
+		// Run the scripts, which call Parallel
+		r.wait()
 	}()
-	if r.failed && len(r.children) == 0 {
+	var deadline <-chan time.Time
+	if info.timeout > 0 {
+		deadline = time.After(info.timeout)
+	}
+	moduleTimedOut := false
+	select {
+	case p := <-done:
+		if p != nil {
+			panic(p)
+		}
+	case <-deadline:
+		moduleTimedOut = true
+	}
+	children := r.subtests()
+	if moduleTimedOut {
+		for _, c := range children {
+			if !c.finished() {
+				// info.timeout is what remained of the module timeout after
+				// running any Go tests, so don't report it
+				c.timeOut("module timed out")
+			}
+		}
+		// testscript is now stopping the commands of the scripts that are
+		// still running. Give the scripts a chance to log what they did up
+		// to that point.
+		grace := time.Now().Add(info.timeout/9 + time.Second)
+		for _, c := range children {
+			select {
+			case <-c.exited:
+			case <-time.After(time.Until(grace)):
+			}
+		}
+		// Scripts still write to log and their working directories until
+		// they stop, which they do once testscript has stopped their
+		// commands at params.Deadline, so we must wait for them
+		if p := <-done; p != nil {
+			panic(p)
+		}
+	} else if r.Failed() && len(children) == 0 {
 		// We failed before running any subtests
-		return errors.New(r.log.String())
+		return nil, errors.New(r.output().String())
 	}
-	sort.Slice(r.children, func(i, j int) bool {
-		lhs, rhs := r.children[i], r.children[j]
+	sort.Slice(children, func(i, j int) bool {
+		lhs, rhs := children[i], children[j]
 		return lhs.name < rhs.name
 	})
-	for _, c := range r.children {
+	sawFail, sawTimeout := false, false
+	for _, c := range children {
 		var context []string
 		if info.testerRelPath != "" {
 			context = append(context, info.testerRelPath)
 		}
 		context = append(context, c.name, info.version)
-		if !c.failed && !c.verbose {
-			continue
+		failed := c.Failed()
+		status := "PASS"
+		switch {
+		case c.TimedOut():
+			status = "TIMEOUT"
+			sawTimeout = true
+		case failed:
+			status = "FAIL"
+			sawFail = true
+		case c.Skipped():
+			status = "SKIP"
 		}
-		passFail := "PASS"
-		if c.failed {
-			passFail = "FAIL"
+		sr := scriptResult{name: c.name, status: status, elapsed: c.elapsed()}
+		if failed || c.verbose {
+			output := c.output()
+			sr.output = output.String()
+			fmt.Fprintf(log, "--- %s: %s\n%s", status, path.Join(context...), indent(output, "\t"))
 		}
-		fmt.Fprintf(log, "--- %s: %s\n%s", passFail, path.Join(context...), indent(c.log, "\t"))
+		scripts = append(scripts, sr)
 	}
-	if r.failed {
-		return errTestFail
+	// Scripts fail via their subtests, but testscript can also fail the
+	// test that runs them, e.g. when it cannot set up a script
+	parentFailed := r.Failed() && !sawFail && !sawTimeout
+	if parentFailed {
+		log.Write(r.output().Bytes())
 	}
-	return nil
+	switch {
+	case moduleTimedOut:
+		return scripts, errTestTimeout
+	case sawFail, parentFailed:
+		return scripts, errTestFail
+	case sawTimeout:
+		return scripts, errTestTimeout
+	}
+	return scripts, nil
 }
 
-func dockerRunModule(image string, log io.Writer, info runModuleInfo) (err error) {
+// testscriptDeadline returns the value of testscript.Params.Deadline for
+// which testscript stops the commands run by scripts once timeout has
+// elapsed. testscript reserves two grace periods of 5% of the time until the
+// deadline, but at least 100ms each, for stopping commands.
+func testscriptDeadline(timeout time.Duration) time.Time {
+	d := timeout * 10 / 9
+	if d/20 < 100*time.Millisecond {
+		d = timeout + 200*time.Millisecond
+	}
+	return time.Now().Add(d)
+}
+
+func dockerRunModule(image string, log io.Writer, info runModuleInfo) (scripts []scriptResult, err error) {
 	// TODO we could add support for limiting the concurrency of testscript
 	// tests in the child process via something like:
 	//
 	// https://go2goplay.golang.org/p/YZxV9iVWDqf
+
+	// Name the container, such that we can kill it when it times out and
+	// inspect it once it has stopped. For the latter reason, we remove the
+	// container ourselves as opposed to using --rm.
+	name := containerName()
+	defer removeContainer(name)
 	args := []string{
-		"docker", "run", "--rm", "-t",
+		"docker", "run", "-t",
+		"--name", name,
+	}
+	args = append(args, containerLabelFlags()...)
+	args = append(args, info.limits.dockerFlags()...)
+	args = append(args,
 
 		// All docker images used by unity must support this interface
 		"-e", fmt.Sprintf("USER_UID=%v", os.Geteuid()),
 		"-e", fmt.Sprintf("USER_GID=%v", os.Getegid()),
 
 		// Add mounts
-		"-v", info.manifestDir + ":/unity/manifestDir",
-		"-v", info.workdirRoot + ":/unity/workdirRoot",
-		"-v", info.cuePath + ":/unity/cue",
-		"-v", info.self + ":/unity/unity",
+		"-v", info.manifestDir+":/unity/manifestDir",
+		"-v", info.workdirRoot+":/unity/workdirRoot",
+		"-v", info.cuePath+":/unity/cue",
+		"-v", info.self+":/unity/unity",
 
 		image,
-
-		"/unity/unity", "docker",
-		"--manifest", "/unity/manifestDir",
-		"--workdirRoot", "/unity/workdirRoot",
-		"--relPath", info.relPath,
-		"--testerRelPath", info.testerRelPath,
-		"--cuePath", "/unity/cue",
-		"--version", info.version,
-	}
-	if info.update {
-		args = append(args, "--update")
-	}
-	if info.verbose {
-		args = append(args, "--verbose")
+	)
+	dockerArgs, err := unityDockerArgs(info, "/unity/unity", "/unity/manifestDir", "/unity/workdirRoot", "/unity/cue")
+	if err != nil {
+		return nil, err
 	}
+	args = append(args, dockerArgs...)
 	// TODO remove the multi-writer
 	var buf bytes.Buffer
 	comb := io.MultiWriter(&buf, log)
 	cmd := exec.Command(args[0], args[1:]...)
 	cmd.Stdout = comb
 	cmd.Stderr = comb
-	if err := cmd.Run(); err != nil {
-		return fmt.Errorf("failed to run [%v]: %v\n%s", cmd, err, buf.Bytes())
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("failed to start [%v]: %v", cmd, err)
 	}
-	return nil
+	var killed atomic.Bool
+	if info.timeout > 0 {
+		// unity docker enforces the timeout itself, so this is a backstop in
+		// case the container does not stop, e.g. because a process ignores
+		// signals. Killing the docker client would leave the container
+		// running, so we kill the container by name.
+		t := time.AfterFunc(info.timeout+dockerKillGrace, func() {
+			killed.Store(true)
+			exec.Command("docker", "kill", name).Run()
+		})
+		defer t.Stop()
+	}
+	err = cmd.Wait()
+	// unity docker writes the results of the scripts it ran, even if they
+	// failed or timed out
+	scripts, readErr := readScriptResults(info.workdirRoot)
+	if err != nil {
+		var exitError *exec.ExitError
+		if killed.Load() || (errors.As(err, &exitError) && exitError.ExitCode() == exitCodeTimeout) {
+			return scripts, errTestTimeout
+		}
+		if containerOOMKilled(name) {
+			return scripts, errTestOOM
+		}
+		return scripts, fmt.Errorf("failed to run [%v]: %v\n%s", cmd, err, buf.Bytes())
+	}
+	return scripts, readErr
 }
 
 // indent returns the indented string version of b
@@ -873,26 +1512,3 @@ func indent(b *bytes.Buffer, indent string) string {
 	}
 	return s
 }
-
-func buildCmdCUE(cuePath, statsDir string) func(ts *testscript.TestScript, neg bool, args []string) {
-	return func(ts *testscript.TestScript, neg bool, args []string) {
-		if len(args) < 1 {
-			ts.Fatalf("usage: cue subcommand ...")
-		}
-		// Use a random stats filename for each cmd/cue invocation,
-		// so that if a single script runs cmd/cue multiple times,
-		// we end up with multiple stats files.
-		ts.Setenv("CUE_STATS_FILE", filepath.Join(statsDir, fmt.Sprintf("%d.json", mathrand.Uint32())))
-		err := ts.Exec(cuePath, args...)
-		if err != nil {
-			ts.Logf("[%v]\n", err)
-			if !neg {
-				ts.Fatalf("unexpected cue command failure")
-			}
-		} else {
-			if neg {
-				ts.Fatalf("unexpected cue command success")
-			}
-		}
-	}
-}
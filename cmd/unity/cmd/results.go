@@ -0,0 +1,381 @@
+// Copyright 2023 The CUE Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"cuelang.org/go/cue/stats"
+	"github.com/spf13/cobra"
+)
+
+const (
+	flagMergeResultsVerbose flagName = "verbose"
+	flagMergeResultsResults flagName = "results"
+	flagMergeResultsJUnit   flagName = "junit"
+)
+
+// resultsVersion is the version of the results file format. It must be
+// incremented whenever the meaning of an existing field changes.
+const resultsVersion = 1
+
+// results is the JSON encoding of the results of a unity test run, as
+// written via --results. The results of the shards of a corpus run can be
+// combined via unity merge-results.
+type results struct {
+	// ResultsVersion is the resultsVersion of the unity that wrote the
+	// results
+	ResultsVersion int
+
+	Results []moduleResult
+
+	// Skipped are the paths of the corpus projects that were skipped
+	Skipped []string `json:",omitempty"`
+}
+
+// moduleResult is the result of testing a module against a version.
+type moduleResult struct {
+	// Project is the path of the module relative to the git root of the
+	// tester, which identifies the module within a corpus
+	Project string
+
+	// Module is the module path
+	Module string
+
+	// Overlays are the overlay directories that applied to the module, in
+	// increasing order of precedence
+	Overlays []string `json:",omitempty"`
+
+	Version         string
+	ResolvedVersion string
+
+	// Status is the status of the result in the results table, e.g. ok
+	Status string
+
+	// Error is the error of a result that was not a test failure, e.g. a
+	// failure to resolve the version
+	Error string `json:",omitempty"`
+
+	Log       string `json:",omitempty"`
+	Duration  time.Duration
+	BuildInfo *cueBuildInfo `json:",omitempty"`
+	GoTests   []goTestJSON  `json:",omitempty"`
+	Scripts   []scriptJSON  `json:",omitempty"`
+
+	CUEStatsCount int `json:",omitempty"`
+	CUEStats      stats.Counts
+}
+
+// goTestJSON is the JSON encoding of a goTestResult.
+type goTestJSON struct {
+	Package string
+	Test    string `json:",omitempty"`
+	Action  string
+	Elapsed time.Duration
+}
+
+// scriptJSON is the JSON encoding of a scriptResult.
+type scriptJSON struct {
+	Name    string
+	Status  string
+	Elapsed time.Duration
+	Output  string `json:",omitempty"`
+}
+
+// encodeScripts returns the JSON encoding of scripts.
+func encodeScripts(scripts []scriptResult) []scriptJSON {
+	var res []scriptJSON
+	for _, r := range scripts {
+		res = append(res, scriptJSON{
+			Name:    r.name,
+			Status:  r.status,
+			Elapsed: r.elapsed,
+			Output:  r.output,
+		})
+	}
+	return res
+}
+
+// decodeScripts returns the scripts encoded by encodeScripts.
+func decodeScripts(scripts []scriptJSON) []scriptResult {
+	var res []scriptResult
+	for _, r := range scripts {
+		res = append(res, scriptResult{
+			name:    r.Name,
+			status:  r.Status,
+			elapsed: r.Elapsed,
+			output:  r.Output,
+		})
+	}
+	return res
+}
+
+// writeResults writes the results of tested, along with the paths of the
+// corpus projects that were skipped, to the file path.
+func writeResults(path string, tested []*testResult, skipped []string) error {
+	res := results{
+		ResultsVersion: resultsVersion,
+		Skipped:        skipped,
+	}
+	for _, tr := range tested {
+		mr := moduleResult{
+			Project:         tr.module.testerRelPath,
+			Module:          tr.module.path,
+			Overlays:        tr.module.overlays,
+			Version:         tr.version,
+			ResolvedVersion: tr.resolvedVersion,
+			Status:          resultStatus(tr.err),
+			Log:             tr.log.String(),
+			Duration:        tr.duration,
+			BuildInfo:       tr.cueBuildInfo,
+			CUEStatsCount:   tr.cueStatsCount,
+			CUEStats:        tr.cueStatsTotal,
+		}
+		if tr.err != nil && !isTestFailure(tr.err) {
+			mr.Error = tr.err.Error()
+		}
+		for _, r := range tr.goTests {
+			mr.GoTests = append(mr.GoTests, goTestJSON{
+				Package: r.pkg,
+				Test:    r.test,
+				Action:  r.action,
+				Elapsed: r.elapsed,
+			})
+		}
+		mr.Scripts = encodeScripts(tr.scripts)
+		res.Results = append(res.Results, mr)
+	}
+	data, err := json.MarshalIndent(res, "", "\t")
+	if err != nil {
+		return fmt.Errorf("failed to encode results: %v", err)
+	}
+	if err := os.WriteFile(path, append(data, '\n'), 0666); err != nil {
+		return fmt.Errorf("failed to write results: %v", err)
+	}
+	return nil
+}
+
+// readResults reads a results file written by writeResults.
+func readResults(path string) (*results, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read results: %v", err)
+	}
+	var res results
+	if err := json.Unmarshal(data, &res); err != nil {
+		return nil, fmt.Errorf("failed to decode results from %s: %v", path, err)
+	}
+	if res.ResultsVersion != resultsVersion {
+		return nil, fmt.Errorf("unsupported results version %d in %s; want %d", res.ResultsVersion, path, resultsVersion)
+	}
+	return &res, nil
+}
+
+// testResults converts the results of res back to test results, such that
+// they can be reported by reportResults. The modules of the test results
+// only have their path, testerRelPath and overlays set.
+func (res *results) testResults() (tested []*testResult, firstResult map[*module]*testResult) {
+	modules := make(map[string]*module)
+	firstResult = make(map[*module]*testResult)
+	for _, mr := range res.Results {
+		m := modules[mr.Project]
+		if m == nil {
+			m = &module{path: mr.Module, testerRelPath: mr.Project, overlays: mr.Overlays}
+			modules[mr.Project] = m
+		}
+		tr := &testResult{
+			module:          m,
+			version:         mr.Version,
+			resolvedVersion: mr.ResolvedVersion,
+			log:             bytes.NewBufferString(mr.Log),
+			duration:        mr.Duration,
+			cueBuildInfo:    mr.BuildInfo,
+			cueStatsCount:   mr.CUEStatsCount,
+			cueStatsTotal:   mr.CUEStats,
+		}
+		switch {
+		case mr.Error != "":
+			tr.err = errors.New(mr.Error)
+		case mr.Status == "TIMEOUT":
+			tr.err = errTestTimeout
+		case mr.Status == "OOM":
+			tr.err = errTestOOM
+		case mr.Status != "ok":
+			tr.err = errTestFail
+		}
+		for _, r := range mr.GoTests {
+			tr.goTests = append(tr.goTests, goTestResult{
+				pkg:     r.Package,
+				test:    r.Test,
+				action:  r.Action,
+				elapsed: r.Elapsed,
+			})
+		}
+		tr.scripts = decodeScripts(mr.Scripts)
+		if _, ok := firstResult[m]; !ok {
+			firstResult[m] = tr
+		}
+		tested = append(tested, tr)
+	}
+	return tested, firstResult
+}
+
+// parseShard parses a --shard value of the form i/N, where 1 <= i <= N.
+func parseShard(s string) (i, n int, err error) {
+	parts := strings.Split(s, "/")
+	ok := len(parts) == 2
+	if ok {
+		i, err = strconv.Atoi(parts[0])
+	}
+	if ok && err == nil {
+		n, err = strconv.Atoi(parts[1])
+	}
+	if !ok || err != nil || n < 1 || i < 1 || i > n {
+		return 0, 0, fmt.Errorf("invalid shard %q; want i/N with 1 <= i <= N", s)
+	}
+	return i, n, nil
+}
+
+// shardModules returns the modules of shard i of n, where 1 <= i <= n. The
+// modules are partitioned deterministically by path. Without durations,
+// modules are dealt to shards in turn. Otherwise, the modules are balanced by
+// their durations, keyed by testerRelPath, with modules that have no duration
+// assumed to take the mean duration.
+func shardModules(modules []*module, i, n int, durations map[string]time.Duration) []*module {
+	sorted := append([]*module(nil), modules...)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].testerRelPath < sorted[j].testerRelPath
+	})
+	shard := make(map[*module]int)
+	if len(durations) == 0 {
+		for k, m := range sorted {
+			shard[m] = k % n
+		}
+	} else {
+		var total time.Duration
+		for _, d := range durations {
+			total += d
+		}
+		mean := total / time.Duration(len(durations))
+		weight := func(m *module) time.Duration {
+			if d, ok := durations[m.testerRelPath]; ok {
+				return d
+			}
+			return mean
+		}
+		// Assign the longest modules first, each to the shard with the least
+		// total duration so far
+		sort.SliceStable(sorted, func(i, j int) bool {
+			return weight(sorted[i]) > weight(sorted[j])
+		})
+		loads := make([]time.Duration, n)
+		for _, m := range sorted {
+			least := 0
+			for k := range loads {
+				if loads[k] < loads[least] {
+					least = k
+				}
+			}
+			shard[m] = least
+			loads[least] += weight(m)
+		}
+	}
+	var res []*module
+	for _, m := range modules {
+		if shard[m] == i-1 {
+			res = append(res, m)
+		}
+	}
+	return res
+}
+
+// resultsDurations returns the total duration of the results of each module
+// in the results file path, keyed by project.
+func resultsDurations(path string) (map[string]time.Duration, error) {
+	res, err := readResults(path)
+	if err != nil {
+		return nil, err
+	}
+	durations := make(map[string]time.Duration)
+	for _, mr := range res.Results {
+		durations[mr.Project] += mr.Duration
+	}
+	return durations, nil
+}
+
+// newMergeResultsCmd creates the merge-results command
+func newMergeResultsCmd(c *Command) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "merge-results <file>...",
+		Short: "combine the results of unity test runs",
+		Long: `
+merge-results combines the results files written by unity test --results, for
+example by the shards of a corpus run via --shard, and reports them as a single
+table. merge-results fails if any of the tests failed.
+`,
+		RunE: mkRunE(c, mergeResultsDef),
+	}
+	cmd.Flags().BoolP(string(flagMergeResultsVerbose), "v", false, "verbose output; log all script runs")
+	cmd.Flags().String(string(flagMergeResultsResults), "", "write the combined results as JSON to this file")
+	cmd.Flags().String(string(flagMergeResultsJUnit), "", "write the combined results as a JUnit XML report to this file")
+	return cmd
+}
+
+func mergeResultsDef(c *Command, args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("no results files to merge")
+	}
+	merged := &results{ResultsVersion: resultsVersion}
+	skipped := make(map[string]bool)
+	for _, path := range args {
+		res, err := readResults(path)
+		if err != nil {
+			return err
+		}
+		merged.Results = append(merged.Results, res.Results...)
+		for _, p := range res.Skipped {
+			// Each shard reports the same skipped projects
+			if !skipped[p] {
+				skipped[p] = true
+				merged.Skipped = append(merged.Skipped, p)
+			}
+		}
+	}
+	tested, firstResult := merged.testResults()
+	if out := flagMergeResultsResults.String(c); out != "" {
+		if err := writeResults(out, tested, merged.Skipped); err != nil {
+			return err
+		}
+	}
+	if out := flagMergeResultsJUnit.String(c); out != "" {
+		if err := writeJUnit(out, tested, merged.Skipped); err != nil {
+			return err
+		}
+	}
+	err := reportResults(tested, firstResult, merged.Skipped, flagMergeResultsVerbose.Bool(c))
+	if errors.Is(err, errTestFail) {
+		// we will have printed everything we need to
+		exit()
+	}
+	return err
+}
@@ -0,0 +1,92 @@
+// Copyright 2023 The CUE Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestShardModules(t *testing.T) {
+	var modules []*module
+	for _, p := range []string{"e", "d", "c", "b", "a"} {
+		modules = append(modules, &module{testerRelPath: p})
+	}
+	shardPaths := func(n int, durations map[string]time.Duration) [][]string {
+		var res [][]string
+		seen := make(map[*module]bool)
+		for i := 1; i <= n; i++ {
+			var paths []string
+			for _, m := range shardModules(modules, i, n, durations) {
+				if seen[m] {
+					t.Fatalf("module %s is in more than one shard", m.testerRelPath)
+				}
+				seen[m] = true
+				paths = append(paths, m.testerRelPath)
+			}
+			res = append(res, paths)
+		}
+		if len(seen) != len(modules) {
+			t.Fatalf("got %d modules across shards; want %d", len(seen), len(modules))
+		}
+		return res
+	}
+
+	tests := []struct {
+		name      string
+		n         int
+		durations map[string]time.Duration
+		want      [][]string
+	}{{
+		name: "NoDurations",
+		n:    2,
+		want: [][]string{{"e", "c", "a"}, {"d", "b"}},
+	}, {
+		name: "Balanced",
+		n:    2,
+		durations: map[string]time.Duration{
+			"a": 4 * time.Second,
+			"b": 3 * time.Second,
+			"c": 2 * time.Second,
+			"d": 2 * time.Second,
+			"e": 1 * time.Second,
+		},
+		// Each shard takes 6s
+		want: [][]string{{"d", "a"}, {"e", "c", "b"}},
+	}, {
+		// d and e have no duration, so are assumed to take the mean of 3s,
+		// such that each shard takes 7.5s
+		name: "Missing",
+		n:    2,
+		durations: map[string]time.Duration{
+			"a": 6 * time.Second,
+			"b": 1500 * time.Millisecond,
+			"c": 1500 * time.Millisecond,
+		},
+		want: [][]string{{"b", "a"}, {"e", "d", "c"}},
+	}, {
+		name: "MoreShardsThanModules",
+		n:    6,
+		want: [][]string{{"a"}, {"b"}, {"c"}, {"d"}, {"e"}, nil},
+	}}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := shardPaths(test.n, test.durations); !reflect.DeepEqual(got, test.want) {
+				t.Errorf("got shards %q; want %q", got, test.want)
+			}
+		})
+	}
+}
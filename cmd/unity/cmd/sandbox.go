@@ -0,0 +1,388 @@
+// Copyright 2023 The CUE Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"cuelang.org/go/cue/errors"
+	"github.com/spf13/cobra"
+)
+
+const (
+	// sandboxDocker is the sandbox of safe mode that runs scripts and Go
+	// tests in Docker containers
+	sandboxDocker = "docker"
+
+	// sandboxNamespace is the sandbox of safe mode that runs scripts and Go
+	// tests in unprivileged Linux namespaces, via bubblewrap if it is
+	// available, for hosts that cannot run Docker
+	sandboxNamespace = "namespace"
+
+	flagSandboxInitRoot flagName = "root"
+	flagSandboxInitRO   flagName = "ro"
+	flagSandboxInitRW   flagName = "rw"
+	flagSandboxInitDir  flagName = "dir"
+)
+
+// sandboxSystemDirs are the host directories that are available read-only
+// within the namespace sandbox, such that scripts can run standard tools like
+// sh. Directories that do not exist on the host are ignored.
+var sandboxSystemDirs = []string{"/usr", "/bin", "/sbin", "/lib", "/lib32", "/lib64", "/libx32"}
+
+// sandboxDevices are the devices that are available within the namespace
+// sandbox.
+var sandboxDevices = []string{"/dev/null", "/dev/zero", "/dev/full", "/dev/random", "/dev/urandom"}
+
+// sandbox describes a process to be run in the namespace sandbox. Other than
+// sandboxSystemDirs, a fresh /tmp, /proc and a minimal /dev, only the paths
+// in ro and rw are available within the sandbox, at the same paths as on the
+// host. Nothing from the host environment is inherited.
+type sandbox struct {
+	// ro are the host paths that are available read-only
+	ro []string
+
+	// rw are the host paths that are available read-write
+	rw []string
+
+	// dir is the working directory of the process
+	dir string
+
+	// env is the environment of the process in addition to sandboxEnv
+	env []string
+
+	// network indicates that the process shares the network of the host.
+	// Otherwise it only has a loopback interface.
+	network bool
+}
+
+// sandboxEnv is the base environment of a process in the namespace sandbox.
+var sandboxEnv = []string{
+	"PATH=/usr/local/bin:/usr/bin:/bin:/usr/local/sbin:/usr/sbin:/sbin",
+	"HOME=/tmp",
+	"TMPDIR=/tmp",
+}
+
+// mounts returns the paths of s along with whether they are read-only,
+// sorted such that a path is mounted before any path within it.
+func (s sandbox) mounts() []sandboxMount {
+	var res []sandboxMount
+	for _, p := range s.ro {
+		res = append(res, sandboxMount{path: p, ro: true})
+	}
+	for _, p := range s.rw {
+		res = append(res, sandboxMount{path: p})
+	}
+	sort.SliceStable(res, func(i, j int) bool {
+		return len(res[i].path) < len(res[j].path)
+	})
+	return res
+}
+
+type sandboxMount struct {
+	path string
+	ro   bool
+}
+
+// command returns a command that runs args within s. It uses bubblewrap if
+// it is on PATH, and otherwise runs self as the init process of new
+// namespaces via unity sandbox-init. The returned cleanup function must be
+// called once the command has finished.
+func (s sandbox) command(self string, args ...string) (cmd *exec.Cmd, cleanup func(), err error) {
+	env := append(append([]string(nil), sandboxEnv...), s.env...)
+	if bwrap, err := exec.LookPath("bwrap"); err == nil {
+		cmd := exec.Command(bwrap, s.bwrapArgs(args)...)
+		cmd.Env = env
+		return cmd, func() {}, nil
+	}
+	root, err := os.MkdirTemp("", "unity-sandbox-root")
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to create sandbox root: %v", err)
+	}
+	initArgs := []string{"sandbox-init",
+		"--" + string(flagSandboxInitRoot), root,
+		"--" + string(flagSandboxInitDir), s.dir,
+	}
+	for _, p := range s.ro {
+		initArgs = append(initArgs, "--"+string(flagSandboxInitRO), p)
+	}
+	for _, p := range s.rw {
+		initArgs = append(initArgs, "--"+string(flagSandboxInitRW), p)
+	}
+	initArgs = append(initArgs, "--")
+	initArgs = append(initArgs, args...)
+	cmd = exec.Command(self, initArgs...)
+	cmd.Env = env
+	if err := s.namespaces(cmd); err != nil {
+		os.Remove(root)
+		return nil, nil, err
+	}
+	return cmd, func() { os.Remove(root) }, nil
+}
+
+// bwrapArgs returns the bubblewrap arguments to run args within s.
+func (s sandbox) bwrapArgs(args []string) []string {
+	res := []string{"--unshare-all", "--die-with-parent", "--new-session"}
+	if s.network {
+		res = append(res, "--share-net")
+	}
+	for _, d := range sandboxSystemDirs {
+		res = append(res, "--ro-bind-try", d, d)
+	}
+	res = append(res, "--dev", "/dev", "--proc", "/proc", "--tmpfs", "/tmp")
+	for _, m := range s.mounts() {
+		if m.ro {
+			res = append(res, "--ro-bind", m.path, m.path)
+		} else {
+			res = append(res, "--bind", m.path, m.path)
+		}
+	}
+	res = append(res, "--remount-ro", "/", "--chdir", s.dir, "--")
+	return append(res, args...)
+}
+
+// nsexecFlag returns the go test -exec flag that runs test binaries via
+// unity nsexec within s. nsexec adds the directory of the test binary.
+func nsexecFlag(self string, s sandbox) (string, error) {
+	args := []string{self, "nsexec"}
+	for _, p := range s.ro {
+		args = append(args, "--ro="+p)
+	}
+	for _, p := range s.rw {
+		args = append(args, "--rw="+p)
+	}
+	if len(s.env) > 0 {
+		args = append(args, envFlag(s.env))
+	}
+	if s.network {
+		args = append(args, "--network")
+	}
+	return execFlag(args...)
+}
+
+// execFlag returns the go test -exec flag that runs test binaries via the
+// command args. go test splits the flag on spaces, other than within single
+// or double quotes, so we quote the arguments that need it.
+func execFlag(args ...string) (string, error) {
+	var quoted []string
+	for _, a := range args {
+		switch {
+		case a != "" && !strings.ContainsAny(a, " \t\n\r'\""):
+		case !strings.Contains(a, "'"):
+			a = "'" + a + "'"
+		case !strings.Contains(a, `"`):
+			a = `"` + a + `"`
+		default:
+			return "", fmt.Errorf("cannot pass %q via go test -exec, because it contains both single and double quotes", a)
+		}
+		quoted = append(quoted, a)
+	}
+	return "-exec=" + strings.Join(quoted, " "), nil
+}
+
+// envFlagPrefix is the prefix of the flag of nsexec and dockexec that
+// carries extra environment for test binaries. The environment is encoded,
+// because the values of the environment might contain anything, including
+// the spaces and quotes on which go test splits its -exec flag.
+const envFlagPrefix = "--env64="
+
+// envFlag returns the envFlagPrefix flag that carries env.
+func envFlag(env []string) string {
+	return envFlagPrefix + base64.StdEncoding.EncodeToString([]byte(strings.Join(env, "\x00")))
+}
+
+// parseEnvFlag decodes the environment carried by arg, an envFlagPrefix flag.
+func parseEnvFlag(arg string) ([]string, error) {
+	b, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(arg, envFlagPrefix))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode %s: %v", arg, err)
+	}
+	if len(b) == 0 {
+		return nil, nil
+	}
+	return strings.Split(string(b), "\x00"), nil
+}
+
+// sandboxRunModule is the namespace sandbox equivalent of dockerRunModule:
+// it runs unity docker within a sandbox that only has access to the paths it
+// needs.
+func sandboxRunModule(log io.Writer, info runModuleInfo) ([]scriptResult, error) {
+	s := sandbox{
+		ro:      []string{info.self, info.cuePath},
+		rw:      []string{info.workdirRoot},
+		dir:     info.workdirRoot,
+		network: info.limits.network,
+	}
+	if info.update {
+		// Updates are written to the test scripts
+		s.rw = append(s.rw, info.manifestDir)
+	} else {
+		s.ro = append(s.ro, info.manifestDir)
+	}
+	args, err := unityDockerArgs(info, info.self, info.manifestDir, info.workdirRoot, info.cuePath)
+	if err != nil {
+		return nil, err
+	}
+	cmd, cleanup, err := s.command(info.self, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer cleanup()
+	var buf bytes.Buffer
+	comb := io.MultiWriter(&buf, log)
+	cmd.Stdout = comb
+	cmd.Stderr = comb
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("failed to start [%v]: %v", cmd, err)
+	}
+	var killed atomic.Bool
+	if info.timeout > 0 {
+		// As with dockerRunModule, this is a backstop. Killing the init
+		// process of the sandbox kills all processes within it.
+		t := time.AfterFunc(info.timeout+dockerKillGrace, func() {
+			killed.Store(true)
+			cmd.Process.Kill()
+		})
+		defer t.Stop()
+	}
+	err = cmd.Wait()
+	// unity docker writes the results of the scripts it ran, even if they
+	// failed or timed out
+	scripts, readErr := readScriptResults(info.workdirRoot)
+	if err != nil {
+		var exitError *exec.ExitError
+		if killed.Load() || (errors.As(err, &exitError) && exitError.ExitCode() == exitCodeTimeout) {
+			return scripts, errTestTimeout
+		}
+		return scripts, fmt.Errorf("failed to run [%v]: %v\n%s", cmd, err, buf.Bytes())
+	}
+	return scripts, readErr
+}
+
+// newSandboxInitCmd creates the hidden sandbox-init command, which is the
+// init process of the namespaces of the namespace sandbox when bubblewrap is
+// not available. It sets up the filesystem of the sandbox and then runs its
+// arguments.
+func newSandboxInitCmd(c *Command) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:    "sandbox-init",
+		Hidden: true,
+		RunE:   mkRunE(c, sandboxInitDef),
+	}
+	cmd.Flags().String(string(flagSandboxInitRoot), "", "the empty directory on which to build the root filesystem")
+	cmd.Flags().StringArray(string(flagSandboxInitRO), nil, "a host path to make available read-only")
+	cmd.Flags().StringArray(string(flagSandboxInitRW), nil, "a host path to make available read-write")
+	cmd.Flags().String(string(flagSandboxInitDir), "", "the working directory")
+	return cmd
+}
+
+func sandboxInitDef(c *Command, args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("missing command to run")
+	}
+	s := sandbox{
+		ro:  flagSandboxInitRO.StringArray(c),
+		rw:  flagSandboxInitRW.StringArray(c),
+		dir: flagSandboxInitDir.String(c),
+	}
+	if err := s.setup(flagSandboxInitRoot.String(c)); err != nil {
+		return fmt.Errorf("failed to set up sandbox: %v", err)
+	}
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	err := cmd.Run()
+	var exitError *exec.ExitError
+	if errors.As(err, &exitError) {
+		// Exit with the same code, such as exitCodeTimeout for unity docker
+		os.Exit(exitError.ExitCode())
+	}
+	return err
+}
+
+// newNsexecCmd creates the hidden nsexec command, which is the namespace
+// sandbox equivalent of dockexec. Its arguments are like:
+//
+//	unity nsexec [--ro=path] [--rw=path] [--env64=encoded] [--network] pkg.test [test flags]
+func newNsexecCmd(c *Command) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:    "nsexec",
+		Hidden: true,
+		RunE:   mkRunE(c, nsexecDef),
+
+		// As with dockexec, flags after the binary belong to the binary
+		DisableFlagParsing: true,
+	}
+	return cmd
+}
+
+func nsexecDef(c *Command, args []string) error {
+	var s sandbox
+	for len(args) > 0 && strings.HasPrefix(args[0], "-") {
+		arg := args[0]
+		args = args[1:]
+		switch {
+		case strings.HasPrefix(arg, "--ro="):
+			s.ro = append(s.ro, strings.TrimPrefix(arg, "--ro="))
+		case strings.HasPrefix(arg, "--rw="):
+			s.rw = append(s.rw, strings.TrimPrefix(arg, "--rw="))
+		case strings.HasPrefix(arg, envFlagPrefix):
+			env, err := parseEnvFlag(arg)
+			if err != nil {
+				return err
+			}
+			s.env = append(s.env, env...)
+		case arg == "--network":
+			s.network = true
+		default:
+			return fmt.Errorf("unknown flag %s", arg)
+		}
+	}
+	if len(args) == 0 {
+		return fmt.Errorf("could not find the test binary argument")
+	}
+	dir, err := os.Getwd()
+	if err != nil {
+		return fmt.Errorf("failed to get working directory: %v", err)
+	}
+	s.dir = dir
+	// go test uses the directory of the test binary for outputs such as
+	// coverage data
+	s.rw = append(s.rw, filepath.Dir(args[0]))
+	self, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("failed to determine path to self: %v", err)
+	}
+	cmd, cleanup, err := s.command(self, args...)
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	return cmd.Run()
+}
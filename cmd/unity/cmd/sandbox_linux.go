@@ -0,0 +1,220 @@
+// Copyright 2023 The CUE Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+// namespaces configures cmd to start in new user, mount, PID, IPC and UTS
+// namespaces, along with a new network namespace unless s.network. The
+// current user is mapped to root within the user namespace, such that the
+// init process has the capabilities it needs to set up mounts.
+func (s sandbox) namespaces(cmd *exec.Cmd) error {
+	flags := syscall.CLONE_NEWUSER | syscall.CLONE_NEWNS | syscall.CLONE_NEWPID | syscall.CLONE_NEWIPC | syscall.CLONE_NEWUTS
+	if !s.network {
+		flags |= syscall.CLONE_NEWNET
+	}
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		Cloneflags:                 uintptr(flags),
+		UidMappings:                []syscall.SysProcIDMap{{ContainerID: 0, HostID: os.Getuid(), Size: 1}},
+		GidMappings:                []syscall.SysProcIDMap{{ContainerID: 0, HostID: os.Getgid(), Size: 1}},
+		GidMappingsEnableSetgroups: false,
+
+		// Don't leave the sandbox running if we die
+		Pdeathsig: syscall.SIGKILL,
+	}
+	return nil
+}
+
+// setup builds the filesystem of s on the empty directory root and makes it
+// the root directory of the current process, which must be the init process
+// of the namespaces created per namespaces.
+func (s sandbox) setup(root string) error {
+	// Don't propagate any of our mounts to the host
+	if err := syscall.Mount("", "/", "", syscall.MS_REC|syscall.MS_PRIVATE, ""); err != nil {
+		return fmt.Errorf("failed to make mounts private: %v", err)
+	}
+	if err := syscall.Mount("tmpfs", root, "tmpfs", 0, "mode=0755"); err != nil {
+		return fmt.Errorf("failed to mount root: %v", err)
+	}
+	for _, d := range sandboxSystemDirs {
+		if _, err := os.Stat(d); err != nil {
+			continue
+		}
+		if err := bindMount(root, d, true); err != nil {
+			return err
+		}
+	}
+	for _, d := range sandboxDevices {
+		if err := bindMount(root, d, false); err != nil {
+			return err
+		}
+	}
+	proc := filepath.Join(root, "proc")
+	if err := os.Mkdir(proc, 0755); err != nil {
+		return err
+	}
+	if err := syscall.Mount("proc", proc, "proc", syscall.MS_NOSUID|syscall.MS_NODEV|syscall.MS_NOEXEC, ""); err != nil {
+		return fmt.Errorf("failed to mount /proc: %v", err)
+	}
+	tmp := filepath.Join(root, "tmp")
+	if err := os.Mkdir(tmp, 0755); err != nil {
+		return err
+	}
+	if err := syscall.Mount("tmpfs", tmp, "tmpfs", syscall.MS_NOSUID|syscall.MS_NODEV, "mode=1777"); err != nil {
+		return fmt.Errorf("failed to mount /tmp: %v", err)
+	}
+	for _, m := range s.mounts() {
+		if err := bindMount(root, m.path, m.ro); err != nil {
+			return err
+		}
+	}
+
+	// Switch to the new root, and detach the old one such that none of the
+	// host filesystem remains reachable
+	const oldRoot = ".oldroot"
+	if err := os.Mkdir(filepath.Join(root, oldRoot), 0700); err != nil {
+		return err
+	}
+	if err := syscall.PivotRoot(root, filepath.Join(root, oldRoot)); err != nil {
+		return fmt.Errorf("failed to pivot root: %v", err)
+	}
+	if err := os.Chdir("/"); err != nil {
+		return err
+	}
+	if err := syscall.Unmount("/"+oldRoot, syscall.MNT_DETACH); err != nil {
+		return fmt.Errorf("failed to unmount old root: %v", err)
+	}
+	if err := os.Remove("/" + oldRoot); err != nil {
+		return err
+	}
+	if err := syscall.Mount("", "/", "", syscall.MS_REMOUNT|syscall.MS_RDONLY, ""); err != nil {
+		return fmt.Errorf("failed to make root read-only: %v", err)
+	}
+	if err := os.Chdir(s.dir); err != nil {
+		return fmt.Errorf("failed to change to working directory: %v", err)
+	}
+	return nil
+}
+
+// lockedMountFlags maps the statfs flags of a mount to the mount flags that
+// must be preserved when remounting it within a user namespace.
+var lockedMountFlags = []struct {
+	statfs, mount uintptr
+}{
+	{0x2, syscall.MS_NOSUID},
+	{0x4, syscall.MS_NODEV},
+	{0x8, syscall.MS_NOEXEC},
+	{0x400, syscall.MS_NOATIME},
+	{0x800, syscall.MS_NODIRATIME},
+	{0x1000, syscall.MS_RELATIME},
+}
+
+// bindMount makes the host path p available at the same path below root,
+// read-only if ro.
+func bindMount(root, p string, ro bool) error {
+	fi, err := os.Stat(p)
+	if err != nil {
+		return fmt.Errorf("failed to make %s available: %v", p, err)
+	}
+	target := filepath.Join(root, p)
+	if fi.IsDir() {
+		if err := os.MkdirAll(target, 0755); err != nil {
+			return err
+		}
+	} else {
+		if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+			return err
+		}
+		f, err := os.OpenFile(target, os.O_CREATE|os.O_WRONLY, 0644)
+		if err != nil {
+			return err
+		}
+		f.Close()
+	}
+	if err := syscall.Mount(p, target, "", syscall.MS_BIND|syscall.MS_REC, ""); err != nil {
+		return fmt.Errorf("failed to bind mount %s: %v", p, err)
+	}
+	if !ro {
+		return nil
+	}
+	// MS_RDONLY only applies to the mount it is given, as opposed to the
+	// mounts below it that MS_REC bound along with it, so we make each of
+	// them read-only in turn
+	f, err := os.Open("/proc/self/mountinfo")
+	if err != nil {
+		return fmt.Errorf("failed to list mounts: %v", err)
+	}
+	defer f.Close()
+	mounts, err := mountPoints(f, target)
+	if err != nil {
+		return fmt.Errorf("failed to list mounts: %v", err)
+	}
+	for _, m := range mounts {
+		if err := remountReadOnly(m); err != nil {
+			return fmt.Errorf("failed to make %s read-only: %v", m, err)
+		}
+	}
+	return nil
+}
+
+// remountReadOnly makes the bind mount at target read-only.
+func remountReadOnly(target string) error {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(target, &st); err != nil {
+		return err
+	}
+	flags := uintptr(syscall.MS_BIND | syscall.MS_REMOUNT | syscall.MS_RDONLY)
+	for _, f := range lockedMountFlags {
+		if uintptr(st.Flags)&f.statfs != 0 {
+			flags |= f.mount
+		}
+	}
+	return syscall.Mount("", target, "", flags, "")
+}
+
+// mountinfoUnescaper undoes the octal escaping of spaces, tabs, newlines and
+// backslashes in the paths of /proc/self/mountinfo.
+var mountinfoUnescaper = strings.NewReplacer(`\040`, " ", `\011`, "\t", `\012`, "\n", `\134`, `\`)
+
+// mountPoints returns the mount points listed by r, in the format of
+// /proc/self/mountinfo, that are dir or below it, in the order they were
+// mounted.
+func mountPoints(r io.Reader, dir string) ([]string, error) {
+	var res []string
+	sc := bufio.NewScanner(r)
+	for sc.Scan() {
+		fields := strings.Fields(sc.Text())
+		if len(fields) < 5 {
+			return nil, fmt.Errorf("invalid mountinfo line %q", sc.Text())
+		}
+		p := mountinfoUnescaper.Replace(fields[4])
+		if p == dir || strings.HasPrefix(p, dir+"/") {
+			res = append(res, p)
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
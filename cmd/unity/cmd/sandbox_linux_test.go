@@ -0,0 +1,40 @@
+// Copyright 2023 The CUE Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const mountinfo = `22 1 0:21 / / rw,relatime - ext4 /dev/sda1 rw
+23 22 0:22 / /root/a rw,relatime - tmpfs none rw
+24 23 0:23 / /root/a/sub rw,relatime - tmpfs none rw
+25 23 0:24 / /root/a/with\040space rw,relatime - tmpfs none rw
+26 22 0:25 / /root/ab rw,relatime - tmpfs none rw
+27 24 0:26 / /root/a/sub/deeper rw,relatime - tmpfs none rw
+`
+
+func TestMountPoints(t *testing.T) {
+	got, err := mountPoints(strings.NewReader(mountinfo), "/root/a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"/root/a", "/root/a/sub", "/root/a/with space", "/root/a/sub/deeper"}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("got mount points %q; want %q", got, want)
+	}
+}
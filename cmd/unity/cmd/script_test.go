@@ -73,10 +73,23 @@ func TestScripts(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	for _, unityUnsafe := range []bool{false, true} {
-		unityUnsafe := unityUnsafe
-		t.Run(fmt.Sprintf("unsafe=%t", unityUnsafe), func(t *testing.T) {
+	for _, config := range []struct {
+		name    string
+		unsafe  bool
+		sandbox string
+	}{
+		{"unsafe=false", false, sandboxDocker},
+		{"unsafe=false,sandbox=namespace", false, sandboxNamespace},
+		{"unsafe=true", true, ""},
+	} {
+		unityUnsafe, sandbox := config.unsafe, config.sandbox
+		t.Run(config.name, func(t *testing.T) {
 			t.Parallel()
+			if sandbox == sandboxNamespace {
+				if err := probeSandbox(selfPath); err != nil {
+					t.Skipf("namespace sandbox not available: %v", err)
+				}
+			}
 			testscript.Run(t, testscript.Params{
 				Dir: filepath.Join("testdata", "scripts"),
 				Setup: func(env *testscript.Env) (err error) {
@@ -97,6 +110,7 @@ func TestScripts(t *testing.T) {
 					env.Setenv(homeEnvName(), home)
 					env.Setenv("UNITY_SEMVER_URL_TEMPLATE", "file://"+filepath.Join(cwd, "testdata", "archives", "{{.Artefact}}"))
 					env.Setenv("UNITY_UNSAFE", fmt.Sprintf("%t", unityUnsafe))
+					env.Setenv("UNITY_SANDBOX", sandbox)
 					env.Setenv("UNITY_TESTSCRIPT", "true")
 
 					// Always run git config steps
@@ -114,7 +128,17 @@ func TestScripts(t *testing.T) {
 					}
 					return nil
 				},
-				Condition:           cuetest.Condition,
+				Condition: func(cond string) (bool, error) {
+					switch cond {
+					case "unsafe":
+						// unity runs scripts and Go tests without a sandbox
+						return unityUnsafe, nil
+					case sandboxDocker, sandboxNamespace:
+						// unity runs scripts and Go tests in the named sandbox
+						return !unityUnsafe && sandbox == cond, nil
+					}
+					return cuetest.Condition(cond)
+				},
 				RequireExplicitExec: true,
 				UpdateScripts:       os.Getenv("CUE_UPDATE") != "",
 			})
@@ -122,6 +146,23 @@ func TestScripts(t *testing.T) {
 	}
 }
 
+// probeSandbox reports whether the namespace sandbox works on this host,
+// using the unity binary self.
+func probeSandbox(self string) error {
+	if runtime.GOOS != "linux" {
+		return fmt.Errorf("requires Linux")
+	}
+	cmd, cleanup, err := sandbox{dir: "/"}.command(self, "true")
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("%v\n%s", err, out)
+	}
+	return nil
+}
+
 const specialUnquote = ".unquote"
 
 // processSpecialFiles performs pre-script setup using the existence of
@@ -142,6 +142,20 @@ func (sr *semverResolver) resolve(version, dir, working, target string) (string,
 	return version, copyExecutableFile(ce, target)
 }
 
+func (sr *semverResolver) goModReplace(version, dir, working string) (string, error) {
+	if !semver.IsValid(version) {
+		return "", errNoMatch
+	}
+	return cueModule + "@" + version, nil
+}
+
+func (sr *semverResolver) check(version string) error {
+	if !semver.IsValid(version) {
+		return errNoMatch
+	}
+	return nil
+}
+
 type semverURLData struct {
 	// Version is the version requested
 	Version string
@@ -19,6 +19,7 @@ import (
 	"io/fs"
 	"os"
 	"path/filepath"
+	"runtime"
 	"strings"
 
 	"cuelang.org/go/cue"
@@ -34,18 +35,34 @@ import (
 )
 
 const (
-	flagTestUpdate      flagName = "update"
-	flagTestCorpus      flagName = "corpus"
-	flagTestRun         flagName = "run"
-	flagTestDir         flagName = "dir"
-	flagTestVerbose     flagName = "verbose"
-	flagTestNoPath      flagName = "nopath"
-	flagTestOverlay     flagName = "overlay"
-	flagTestUnsafe      flagName = "unsafe"
-	flagTestStaged      flagName = "staged"
-	flagTestIgnoreDirty flagName = "ignore-dirty"
-	flagTestSelf        flagName = "self"
-	flagTestSkipBase    flagName = "skip-base"
+	flagTestUpdate        flagName = "update"
+	flagTestCorpus        flagName = "corpus"
+	flagTestCorpusFile    flagName = "corpus-file"
+	flagTestRequireAll    flagName = "require-all"
+	flagTestInit          flagName = "init"
+	flagTestShard         flagName = "shard"
+	flagTestShardDuration flagName = "shard-durations"
+	flagTestResults       flagName = "results"
+	flagTestJUnit         flagName = "junit"
+	flagTestProject       flagName = "project"
+	flagTestTags          flagName = "tags"
+	flagTestRun           flagName = "run"
+	flagTestDir           flagName = "dir"
+	flagTestVerbose       flagName = "verbose"
+	flagTestNoPath        flagName = "nopath"
+	flagTestOverlay       flagName = "overlay"
+	flagTestUnsafe        flagName = "unsafe"
+	flagTestStaged        flagName = "staged"
+	flagTestIgnoreDirty   flagName = "ignore-dirty"
+	flagTestSelf          flagName = "self"
+	flagTestSkipBase      flagName = "skip-base"
+	flagTestGoTest        flagName = "go-test"
+	flagTestScriptTimeout flagName = "script-timeout"
+	flagTestParallel      flagName = "parallel"
+	flagTestMemory        flagName = "memory"
+	flagTestCPUs          flagName = "cpus"
+	flagTestPidsLimit     flagName = "pids-limit"
+	flagTestSandbox       flagName = "sandbox"
 
 	// dockerImage is the image we use when running in safe mode
 	// TODO(mvdan): replace with dockerImageDefault once we use dockexec for
@@ -73,21 +90,133 @@ Need to document this command
 	}
 	cmd.Flags().Bool(string(flagTestUpdate), false, "update files within test archives when cmp fails")
 	cmd.Flags().Bool(string(flagTestCorpus), false, "run tests for the submodules of the git repository that contains the working directory.")
+	cmd.Flags().String(string(flagTestCorpusFile), "", "run tests for the projects declared in a CUE corpus file instead of git submodules; implies --corpus")
+	cmd.Flags().Bool(string(flagTestRequireAll), false, "in corpus mode, fail if any git submodule is not initialised instead of skipping it")
+	cmd.Flags().Bool(string(flagTestInit), false, "in corpus mode, initialise any git submodules that are not initialised")
+	cmd.Flags().String(string(flagTestShard), "", "in corpus mode, only test shard i/N of the corpus modules, e.g. 1/4")
+	cmd.Flags().String(string(flagTestShardDuration), "", "a results file whose durations are used to balance --shard")
+	cmd.Flags().StringArray(string(flagTestProject), nil, "in corpus mode, only test the modules whose module path or project path matches this glob; may be repeated")
+	cmd.Flags().String(string(flagTestTags), "", "in corpus mode, only test the modules whose manifest has one of these comma-separated Tags")
+	cmd.Flags().String(string(flagTestResults), "", "write the results as JSON to this file, e.g. for unity merge-results")
+	cmd.Flags().String(string(flagTestJUnit), "", "write the results as a JUnit XML report to this file")
 	cmd.Flags().String(string(flagTestRun), ".", "run only those tests matching the regular expression.")
 	cmd.Flags().StringP(string(flagTestDir), "d", ".", "search path for the project or corpus")
-	cmd.Flags().BoolP(string(flagTestVerbose), "v", false, "verbose output; log all script runs")
-	cmd.Flags().Bool(string(flagTestNoPath), false, "do not allow CUE version PATH. Useful for CI")
-	cmd.Flags().String(string(flagTestOverlay), "", "the directory from which to source overlays")
-	cmd.Flags().Bool(string(flagTestUnsafe), os.Getenv("UNITY_UNSAFE") == "true", "do not use Docker for executing scripts")
+	cmd.Flags().StringArray(string(flagTestOverlay), nil, "a directory, or list of directories, from which to source overlays; may be repeated, with later directories taking precedence")
 	cmd.Flags().Bool(string(flagTestStaged), false, "apply staged changes during tests")
 	cmd.Flags().Bool(string(flagTestIgnoreDirty), false, "ignore untracked files, and staged files unless --staged")
-	cmd.Flags().String(string(flagTestSelf), os.Getenv("UNITY_SELF"), "the context within which we can resolve self to build for docker")
 	cmd.Flags().Bool(string(flagTestSkipBase), false, "do not test base versions")
+	addTesterFlags(cmd)
 
 	return cmd
 }
 
+// addTesterFlags adds the flags that configure how modules are tested, which
+// are common to the commands that test modules.
+func addTesterFlags(cmd *cobra.Command) {
+	cmd.Flags().BoolP(string(flagTestVerbose), "v", false, "verbose output; log all script runs")
+	cmd.Flags().Bool(string(flagTestNoPath), false, "do not allow CUE version PATH. Useful for CI")
+	cmd.Flags().Bool(string(flagTestUnsafe), os.Getenv("UNITY_UNSAFE") == "true", "do not use Docker for executing scripts")
+	cmd.Flags().String(string(flagTestSandbox), sandboxDefault(), "the sandbox of safe mode: docker, or namespace for Linux namespaces")
+	cmd.Flags().String(string(flagTestSelf), os.Getenv("UNITY_SELF"), "the context within which we can resolve self to build for docker")
+	cmd.Flags().Bool(string(flagTestGoTest), false, "run test scripts via go test in a temporary module")
+	cmd.Flags().Duration(string(flagTestScriptTimeout), 0, "the time after which a test script fails; zero means no limit")
+	cmd.Flags().Int(string(flagTestParallel), runtime.NumCPU(), "the maximum number of test scripts to run in parallel")
+	cmd.Flags().String(string(flagTestMemory), defaultContainerMemory, "the memory limit of containers in safe mode; empty means no limit")
+	cmd.Flags().String(string(flagTestCPUs), "", "the number of CPUs available to containers in safe mode; empty means no limit")
+	cmd.Flags().Int(string(flagTestPidsLimit), defaultContainerPidsLimit, "the maximum number of processes in containers in safe mode; zero means no limit")
+}
+
 func testDef(c *Command, args []string) error {
+	// Perform some basic validation on the --update flag.
+	if len(args) > 1 && flagTestUpdate.Bool(c) {
+		return fmt.Errorf("cannot supply --update and multiple versions")
+	}
+
+	// Perform some basic validation on the --skip-base flag.
+	if len(args) == 0 && flagTestSkipBase.Bool(c) {
+		return fmt.Errorf("nothing to test")
+	}
+
+	if !flagTestCorpus.Bool(c) && flagTestCorpusFile.String(c) == "" {
+		// These select among the projects of a corpus
+		if len(flagTestProject.StringArray(c)) > 0 {
+			return fmt.Errorf("cannot use --%s without --%s", flagTestProject, flagTestCorpus)
+		}
+		if flagTestTags.String(c) != "" {
+			return fmt.Errorf("cannot use --%s without --%s", flagTestTags, flagTestCorpus)
+		}
+	}
+	if flagTestCorpusFile.String(c) != "" {
+		// A corpus file declares the commits of its projects, which are
+		// always checked out
+		for _, f := range []flagName{flagTestInit, flagTestRequireAll} {
+			if f.Bool(c) {
+				return fmt.Errorf("cannot use --%s with --%s", f, flagTestCorpusFile)
+			}
+		}
+	}
+
+	mt, cleanup, err := newTesterFromFlags(c)
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+
+	if flagTestCorpus.Bool(c) || flagTestCorpusFile.String(c) != "" {
+		return testCorpus(c, mt, args)
+	}
+	err = testProject(c, mt, args)
+	if errors.Is(err, errTestFail) {
+		// we will have printed everything we need to
+		exit()
+	}
+	return err
+}
+
+// overlayDirsFromFlags returns the absolute paths of the --overlay
+// directories of c, verifying that they exist. Each flag value can be a list
+// of directories.
+func overlayDirsFromFlags(c *Command) ([]string, error) {
+	var overlayDirs []string
+	for _, list := range flagTestOverlay.StringArray(c) {
+		for _, overlayDir := range filepath.SplitList(list) {
+			if overlayDir == "" {
+				continue
+			}
+			fi, err := os.Stat(overlayDir)
+			if err != nil {
+				return nil, fmt.Errorf("failed to find overlay directory %s: %v", overlayDir, err)
+			}
+			if !fi.IsDir() {
+				return nil, fmt.Errorf("overlay directory %s is not a directory", overlayDir)
+			}
+			abs, err := filepath.Abs(overlayDir)
+			if err != nil {
+				return nil, fmt.Errorf("failed to make path %s absolute: %v", overlayDir, err)
+			}
+			overlayDirs = append(overlayDirs, abs)
+		}
+	}
+	return overlayDirs, nil
+}
+
+// newTesterFromFlags creates a module tester for the git repository that
+// contains --dir, configured by the flags of c. Flags that c does not define
+// take their zero value. The returned cleanup function must be called once
+// testing is done.
+func newTesterFromFlags(c *Command) (mt *moduleTester, cleanup func(), err error) {
+	var cleanups []func()
+	runCleanups := func() {
+		for i := len(cleanups) - 1; i >= 0; i-- {
+			cleanups[i]()
+		}
+	}
+	defer func() {
+		if err != nil {
+			runCleanups()
+		}
+	}()
+
 	debug := flagDebug.Bool(c)
 
 	ctx := cuecontext.New()
@@ -115,54 +244,60 @@ func testDef(c *Command, args []string) error {
 	// Find the git root
 	gitRoot, err := gitDir(dir, "rev-parse", "--show-toplevel")
 	if err != nil {
-		return fmt.Errorf("failed to determine git root: %v", err)
+		return nil, nil, fmt.Errorf("failed to determine git root: %v", err)
 	}
 	gitRoot = strings.TrimSpace(gitRoot)
 
-	manifestDef := loadManifestSchema(ctx)
+	manifestDef := loadSchema(ctx, "Manifest")
 	if err := manifestDef.Err(); err != nil {
-		return fmt.Errorf("failed to load #Manifest definition: %v", err)
+		return nil, nil, fmt.Errorf("failed to load #Manifest definition: %v", err)
 	}
 
-	// Verify that the overlay directory, if provided, exists
-	overlayDir := flagTestOverlay.String(c)
-	if overlayDir != "" {
-		fi, err := os.Stat(overlayDir)
-		if err != nil {
-			return fmt.Errorf("failed to find overlay directory %s: %v", overlayDir, err)
-		}
-		if !fi.IsDir() {
-			return fmt.Errorf("overlay directory %s is not a directory", overlayDir)
-		}
-		abs, err := filepath.Abs(overlayDir)
-		if err != nil {
-			return fmt.Errorf("failed to make path %s absolute: %v", overlayDir, err)
-		}
-		overlayDir = abs
+	overlayDirs, err := overlayDirsFromFlags(c)
+	if err != nil {
+		return nil, nil, err
+	}
+	if flagTestGoTest.Bool(c) && flagTestScriptTimeout.Duration(c) > 0 {
+		// go test only has a timeout for the whole test binary
+		return nil, nil, fmt.Errorf("--%s is not supported with --%s", flagTestScriptTimeout, flagTestGoTest)
 	}
 
 	bh, err := newBuildHelper()
 	if err != nil {
-		return fmt.Errorf("failed to create build helper: %v", err)
+		return nil, nil, fmt.Errorf("failed to create build helper: %v", err)
 	}
-	defer bh.cache.Trim()
+	cleanups = append(cleanups, func() { bh.cache.Trim() })
 
 	var self string
-	if !flagTestUnsafe.Bool(c) {
+	sandboxName := flagTestSandbox.String(c)
+	switch {
+	case flagTestUnsafe.Bool(c):
+	case sandboxName == sandboxNamespace:
+		// The sandbox runs on the host, so we can use the running binary
+		self, err = os.Executable()
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to derive path to self: %v", err)
+		}
+	case sandboxName == sandboxDocker:
 		if err := bh.targetDocker(dockerImage); err != nil {
-			return fmt.Errorf("failed inspect docker image %s: %v", dockerImage, err)
+			return nil, nil, fmt.Errorf("failed inspect docker image %s: %v", dockerImage, err)
+		}
+		if err := removeStaleContainers(); err != nil {
+			return nil, nil, err
 		}
 		// Work out whether the current GOOS/GOARCH is appropriate for the target
 		// docker image
 		td, err := os.MkdirTemp("", "unity-self-dir")
 		if err != nil {
-			return fmt.Errorf("failed to create a temp directory for self build: %v", err)
+			return nil, nil, fmt.Errorf("failed to create a temp directory for self build: %v", err)
 		}
-		defer os.RemoveAll(td)
+		cleanups = append(cleanups, func() { os.RemoveAll(td) })
 		self, err = bh.pathToSelf(selfDir, td)
 		if err != nil {
-			return fmt.Errorf("failed to derive path to self: %v", err)
+			return nil, nil, fmt.Errorf("failed to derive path to self: %v", err)
 		}
+	default:
+		return nil, nil, fmt.Errorf("unknown sandbox %q", sandboxName)
 	}
 
 	// Note: we can't pre-resolve any versions here because that needs to happen
@@ -173,25 +308,17 @@ func testDef(c *Command, args []string) error {
 		debug:     debug,
 	})
 	if err != nil {
-		return fmt.Errorf("could not create version resolver: %v", err)
-	}
-
-	// Perform some basic validation on the --update flag.
-	if len(args) > 1 && flagTestUpdate.Bool(c) {
-		return fmt.Errorf("cannot supply --update and multiple versions")
-	}
-
-	// Perform some basic validation on the --skip-base flag.
-	if len(args) == 0 && flagTestSkipBase.Bool(c) {
-		return fmt.Errorf("nothing to test")
+		return nil, nil, fmt.Errorf("could not create version resolver: %v", err)
 	}
 
-	mt, err := newModuleTester(moduleTester{
+	mt, err = newModuleTester(moduleTester{
 		self:            self, // only used in safe mode
 		buildHelper:     bh,
 		image:           dockerImage,
 		gitRoot:         gitRoot,
-		overlayDir:      overlayDir,
+		overlayDirs:     overlayDirs,
+		resultsFile:     flagTestResults.String(c),
+		junitFile:       flagTestJUnit.String(c),
 		versionResolver: vr,
 		runtime:         ctx,
 		manifestDef:     manifestDef,
@@ -201,28 +328,39 @@ func testDef(c *Command, args []string) error {
 		ignoreDirty:     flagTestIgnoreDirty.Bool(c),
 		verbose:         flagTestVerbose.Bool(c),
 		skipBase:        flagTestSkipBase.Bool(c),
+		goTestScripts:   flagTestGoTest.Bool(c),
+		scriptTimeout:   flagTestScriptTimeout.Duration(c),
+		parallel:        flagTestParallel.Int(c),
+		sandbox:         sandboxName,
+		limits: containerLimits{
+			memory:    flagTestMemory.String(c),
+			cpus:      flagTestCPUs.String(c),
+			pidsLimit: flagTestPidsLimit.Int(c),
+		},
 	})
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to create module tester: %v", err)
+	}
 	// TODO(mvdan): we should check that removing the temporary directory did
 	// not fail, which could lead to leaving files behind.
 	// We should also add tests that create files to see that we can delete them.
-	defer mt.cleanup()
+	cleanups = append(cleanups, func() { mt.cleanup() })
 
-	if err != nil {
-		return fmt.Errorf("failed to create module tester: %v", err)
-	}
+	return mt, runCleanups, nil
+}
 
-	if flagTestCorpus.Bool(c) {
-		return testCorpus(c, mt, args)
-	}
-	err = testProject(c, mt, args)
-	if errors.Is(err, errTestFail) {
-		// we will have printed everything we need to
-		exit()
+// sandboxDefault returns the default value of --sandbox, which can be set
+// via UNITY_SANDBOX.
+func sandboxDefault() string {
+	if s := os.Getenv("UNITY_SANDBOX"); s != "" {
+		return s
 	}
-	return err
+	return sandboxDocker
 }
 
-func loadManifestSchema(ctx *cue.Context) cue.Value {
+// loadSchema returns the definition def, e.g. Manifest, from the embedded
+// unity package.
+func loadSchema(ctx *cue.Context, def string) cue.Value {
 	overlay := make(map[string]load.Source)
 	fs.WalkDir(unityembed.FS, ".", func(path string, d fs.DirEntry, err error) error {
 		if err != nil {
@@ -243,6 +381,6 @@ func loadManifestSchema(ctx *cue.Context) cue.Value {
 		Overlay: overlay,
 	}
 	bps := load.Instances([]string{"."}, conf)
-	return ctx.BuildInstance(bps[0]).LookupPath(cue.MakePath(cue.Def("Manifest")))
+	return ctx.BuildInstance(bps[0]).LookupPath(cue.MakePath(cue.Def(def)))
 
 }
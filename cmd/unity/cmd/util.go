@@ -20,6 +20,8 @@ import (
 	"os"
 	"os/exec"
 	"strings"
+	"sync"
+	"time"
 
 	"cuelang.org/go/cue/errors"
 	"github.com/rogpeppe/go-internal/testscript"
@@ -44,62 +46,288 @@ func gitEnvDir(env []string, dir string, args ...string) (string, error) {
 
 // runT implements testscript.T and is used in the call to testscript.Run
 //
-// This is basically a poor man's testing.T. Fully flesh this out in order
-// to have parallel runs etc
+// This is basically a poor man's testing.T. As with testing.T, a subtest that
+// calls Parallel is paused until its parent's function returns, and then runs
+// concurrently with its parallel siblings, bounded by limit. Call wait once
+// the top-level function has returned to run the parallel subtests.
 type runT struct {
 	name     string
 	parent   *runT
 	children []*runT
 	verbose  bool
+
+	// limit bounds the number of parallel subtests that run at once. A nil
+	// limit means no bound. It is shared by all runT values in a tree.
+	limit chan struct{}
+
+	// timeout, if non-zero, is the time a subtest may run for before it is
+	// marked as failed. The goroutine of a subtest that times out cannot be
+	// stopped, so it is abandoned, but any output it logs before we report
+	// the result is kept. It is inherited by all runT values in a tree.
+	timeout time.Duration
+
+	// timeouts maps the names of subtests to a timeout that overrides
+	// timeout for that subtest
+	timeouts map[string]time.Duration
+
+	// mu guards children, log, failed, skipped, timedOut, timer, started
+	// and stopped, which can be written by a subtest after we have abandoned
+	// it
+	mu       sync.Mutex
 	log      *bytes.Buffer
 	failed   bool
+	skipped  bool
+	timedOut string
+
+	// started and stopped are when the test started running and finished
+	started time.Time
+	stopped time.Time
+
+	// parallel is closed when the test calls Parallel
+	parallel chan struct{}
+
+	// release is closed when the parallel subtests of the test may run
+	release chan struct{}
+
+	// exited is closed when the function of the test has returned, which
+	// can be after the test timed out
+	exited chan struct{}
+
+	// done is closed when the test has finished or timed out
+	done     chan struct{}
+	doneOnce sync.Once
+	timer    *time.Timer
+
+	// hasSlot indicates that the test holds a slot in limit
+	hasSlot bool
+
+	// running tracks the subtests that have not finished
+	running sync.WaitGroup
 }
 
 func newRunT(name string, parent *runT, verbose bool) *runT {
-	return &runT{
-		name:    name,
-		parent:  parent,
-		log:     new(bytes.Buffer),
-		verbose: verbose,
+	r := &runT{
+		name:     name,
+		parent:   parent,
+		log:      new(bytes.Buffer),
+		verbose:  verbose,
+		parallel: make(chan struct{}),
+		release:  make(chan struct{}),
+		exited:   make(chan struct{}),
+		done:     make(chan struct{}),
 	}
+	if parent != nil {
+		r.limit = parent.limit
+		r.timeout = parent.timeout
+	}
+	return r
 }
 
 var _ testscript.T = (*runT)(nil)
 
 func (r *runT) Skip(is ...interface{}) {
+	r.mu.Lock()
+	r.skipped = true
+	r.mu.Unlock()
 	panic(skipRun)
 }
 
+// Skipped reports whether the test was skipped.
+func (r *runT) Skipped() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.skipped
+}
+
 func (r *runT) Fatal(is ...interface{}) {
 	r.Log(is...)
 	r.FailNow()
 }
 
 func (r *runT) Parallel() {
+	if r.parent == nil {
+		return
+	}
+	close(r.parallel)
+	<-r.parent.release
+	if r.limit != nil {
+		r.limit <- struct{}{}
+		r.hasSlot = true
+	}
+	// The deadline only applies from when the test really starts running
+	r.startTimer()
 }
 
 func (r *runT) Log(is ...interface{}) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
 	fmt.Fprint(r.log, is...)
 }
 
 func (r *runT) FailNow() {
+	r.mu.Lock()
 	r.failed = true
+	r.mu.Unlock()
 	panic(failedRun)
 }
 
+// Failed reports whether the test has failed.
+func (r *runT) Failed() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.failed
+}
+
+// output returns the log of the test, followed by the reason it timed out
+// if it did.
+func (r *runT) output() *bytes.Buffer {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	res := bytes.NewBuffer(append([]byte(nil), r.log.Bytes()...))
+	if r.timedOut != "" {
+		fmt.Fprintln(res, r.timedOut)
+	}
+	return res
+}
+
 func (r *runT) Run(n string, f func(t testscript.T)) {
 	child := newRunT(n, r, r.verbose)
+	if d, ok := r.timeouts[n]; ok {
+		child.timeout = d
+	}
+	r.mu.Lock()
 	r.children = append(r.children, child)
+	r.mu.Unlock()
+	r.running.Add(1)
+	go child.run(f)
+	select {
+	case <-child.parallel:
+		// The child runs once our function returns and wait is called
+	case <-child.done:
+		if child.Failed() {
+			r.mu.Lock()
+			r.failed = true
+			r.mu.Unlock()
+		}
+	}
+}
+
+// run runs f as the function of test r.
+func (r *runT) run(f func(t testscript.T)) {
+	defer close(r.exited)
+	defer r.finish()
+	defer r.wait()
 	defer func() {
 		switch err := recover(); err {
 		case nil, skipRun, failedRun:
 			// Normal operation
-			r.failed = r.failed || child.failed
 		default:
 			panic(err)
 		}
 	}()
-	f(child)
+	r.startTimer()
+	f(r)
+}
+
+// wait runs the parallel subtests of r, and waits for all subtests to finish
+// or time out. It must be called after the function of r has returned.
+func (r *runT) wait() {
+	close(r.release)
+	r.running.Wait()
+	for _, c := range r.subtests() {
+		if c.Failed() {
+			r.mu.Lock()
+			r.failed = true
+			r.mu.Unlock()
+		}
+	}
+}
+
+// startTimer records that r started running, and starts its deadline if
+// there is one.
+func (r *runT) startTimer() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.started = time.Now()
+	if r.timeout == 0 {
+		return
+	}
+	if r.timer != nil {
+		r.timer.Stop()
+	}
+	r.timer = time.AfterFunc(r.timeout, func() {
+		r.timeOut(fmt.Sprintf("test timed out after %v", r.timeout))
+	})
+}
+
+// timeOut marks r as failed because it timed out, with the reason msg, and
+// abandons it if it is still running.
+func (r *runT) timeOut(msg string) {
+	r.mu.Lock()
+	if r.timedOut == "" {
+		r.failed = true
+		r.timedOut = msg
+	}
+	r.mu.Unlock()
+	r.finish()
+}
+
+// TimedOut reports whether the test timed out.
+func (r *runT) TimedOut() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.timedOut != ""
+}
+
+// elapsed returns how long r ran for, or has been running for if it has not
+// finished.
+func (r *runT) elapsed() time.Duration {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.started.IsZero() {
+		return 0
+	}
+	if r.stopped.IsZero() {
+		return time.Since(r.started)
+	}
+	return r.stopped.Sub(r.started)
+}
+
+// subtests returns the subtests that r has run so far.
+func (r *runT) subtests() []*runT {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]*runT(nil), r.children...)
+}
+
+// finished reports whether r has finished or timed out.
+func (r *runT) finished() bool {
+	select {
+	case <-r.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// finish marks r as finished, whether because its function returned or
+// because it timed out, whichever happens first.
+func (r *runT) finish() {
+	r.doneOnce.Do(func() {
+		r.mu.Lock()
+		r.stopped = time.Now()
+		if r.timer != nil {
+			r.timer.Stop()
+		}
+		r.mu.Unlock()
+		if r.hasSlot {
+			<-r.limit
+		}
+		close(r.done)
+		if r.parent != nil {
+			r.parent.running.Done()
+		}
+	})
 }
 
 func (r *runT) Verbose() bool {
@@ -20,6 +20,8 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"regexp"
+	"strings"
 
 	"github.com/cue-unity/unity/internal/copy"
 )
@@ -35,6 +37,17 @@ type resolver interface {
 	// resolve derives version in the context of dir, copying the relevant
 	// binary to target. working can be used as a temporary working directory.
 	resolve(version, dir, working, target string) (string, error)
+
+	// goModReplace returns the replacement for cuelang.org/go that
+	// corresponds to version in the context of dir, in the form expected by
+	// go mod edit -replace. An empty result means that no replacement is
+	// required. working can be used as a temporary working directory.
+	goModReplace(version, dir, working string) (string, error)
+
+	// check verifies that version has the syntax of the versions that the
+	// resolver supports, without resolving it. It returns errNoMatch if the
+	// resolver is not appropriate for version.
+	check(version string) error
 }
 
 func newVersionResolver(c resolverConfig) (*versionResolver, error) {
@@ -56,6 +69,8 @@ func newVersionResolver(c resolverConfig) (*versionResolver, error) {
 		newCommitResolver,
 		newGoModResolver,
 		newChangeResolver,
+		newPRResolver,
+		newLocalResolver,
 	}
 	var resolvers []resolver
 	for i, rb := range inits {
@@ -99,6 +114,78 @@ func (vr *versionResolver) resolve(version, dir, working, target string) (string
 	return versions[0], nil
 }
 
+// check verifies that version, less any environment settings, has the
+// syntax of the versions supported by exactly one resolver, without resolving
+// or building it.
+func (vr *versionResolver) check(version string) error {
+	base, _ := parseVersionEnv(version)
+	matches := 0
+	for _, r := range vr.resolvers {
+		switch err := r.check(base); err {
+		case nil:
+			matches++
+		case errNoMatch:
+		default:
+			return err
+		}
+	}
+	switch matches {
+	case 0:
+		return fmt.Errorf("unknown version syntax %q", version)
+	case 1:
+		return nil
+	}
+	return fmt.Errorf("expected 1 match for %q; got %v", version, matches)
+}
+
+// envSettingRx matches an environment variable setting of the form NAME=value
+var envSettingRx = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*=`)
+
+// parseVersionEnv splits a version argument that carries environment
+// settings, e.g. "v0.9.0+CUE_EXPERIMENT=evalv3", into the CUE version to
+// resolve and the NAME=value settings to apply to each cue invocation.
+// Multiple settings are separated by "+", hence values cannot contain "+".
+// A version without settings is returned as is.
+func parseVersionEnv(version string) (base string, env []string) {
+	parts := strings.Split(version, "+")
+	i := len(parts)
+	for i > 1 && envSettingRx.MatchString(parts[i-1]) {
+		i--
+	}
+	return strings.Join(parts[:i], "+"), parts[i:]
+}
+
+// goModReplace returns the replacement for cuelang.org/go that corresponds to
+// version, such that Go tests can be run against the CUE version under test.
+// See resolver.goModReplace for details.
+func (vr *versionResolver) goModReplace(version, dir, working string) (string, error) {
+	var errs []error
+	var replaces []string
+	for _, r := range vr.resolvers {
+		v, err := r.goModReplace(version, dir, working)
+		switch err {
+		case nil:
+			replaces = append(replaces, v)
+		case errNoMatch:
+		default:
+			errs = append(errs, err)
+		}
+	}
+	if len(errs) > 0 {
+		var buf bytes.Buffer
+		join := ""
+		for _, e := range errs {
+			fmt.Fprintf(&buf, "%v%v", join, e)
+			join = "\n"
+		}
+		return "", fmt.Errorf("got errors during go.mod replacement resolution:\n%s", buf.Bytes())
+	}
+	if l := len(replaces); l != 1 {
+		return "", fmt.Errorf("expected 1 match; got %v", l)
+	}
+	return replaces[0], nil
+}
+
 type resolverConfig struct {
 	bh                 *buildHelper
 	allowPATH          bool
@@ -0,0 +1,313 @@
+// Copyright 2023 The CUE Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"cuelang.org/go/cue/cuecontext"
+	"github.com/rogpeppe/go-internal/imports"
+	"github.com/rogpeppe/go-internal/txtar"
+	"github.com/spf13/cobra"
+)
+
+// scriptCommands are the commands available to test scripts: those built in
+// to testscript, along with cue. The built-in commands are those of scriptCmds
+// in testscript/cmd.go of github.com/rogpeppe/go-internal at the version
+// required by go.mod, v1.9.1-0.20230322215406-00e5e28d9d38, and must be
+// updated along with that requirement.
+var scriptCommands = map[string]bool{
+	"cd":       true,
+	"chmod":    true,
+	"cmp":      true,
+	"cmpenv":   true,
+	"cp":       true,
+	"cue":      true,
+	"env":      true,
+	"exec":     true,
+	"exists":   true,
+	"grep":     true,
+	"mkdir":    true,
+	"mv":       true,
+	"rm":       true,
+	"skip":     true,
+	"stderr":   true,
+	"stdin":    true,
+	"stdout":   true,
+	"stop":     true,
+	"symlink":  true,
+	"unix2dos": true,
+	"unquote":  true,
+	"wait":     true,
+}
+
+// goVersionCondRx matches the Go release conditions of testscript, e.g.
+// go1.20.
+var goVersionCondRx = regexp.MustCompile(`^go([1-9][0-9]*)\.([1-9][0-9]*)$`)
+
+// knownScriptCondition reports whether cond, less any negation, is one of the
+// conditions of testscript.
+func knownScriptCondition(cond string) bool {
+	switch {
+	case cond == "short", cond == "net", cond == "link", cond == "symlink",
+		cond == "unix", cond == "gc", cond == "gccgo":
+		return true
+	case imports.KnownOS[cond], imports.KnownArch[cond]:
+		return true
+	case strings.HasPrefix(cond, "exec:"):
+		return true
+	}
+	return goVersionCondRx.MatchString(cond)
+}
+
+// newVetCmd creates the vet command
+func newVetCmd(c *Command) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "vet",
+		Short: "check the tests manifests and scripts of a project",
+		Long: `
+vet checks the tests of each of the CUE modules of the git repository that
+contains --dir, found in the same way as unity test, along with their
+overlays, without running them.
+
+vet reports:
+
+* manifests that do not satisfy #Manifest
+* Versions that are not of the syntax of any CUE version that unity supports
+* test scripts that cannot be parsed, or that have files within repo/
+* unknown commands and conditions in test scripts
+* files in test script archives that the script does not refer to
+`,
+		RunE: mkRunE(c, vetDef),
+	}
+	cmd.Flags().StringP(string(flagTestDir), "d", ".", "a directory within the project")
+	cmd.Flags().StringArray(string(flagTestOverlay), nil, "a directory, or list of directories, from which to source overlays; may be repeated, with later directories taking precedence")
+	cmd.Flags().Bool(string(flagTestNoPath), false, "do not allow CUE version PATH. Useful for CI")
+	return cmd
+}
+
+func vetDef(c *Command, args []string) error {
+	gitRoot, err := gitDir(flagTestDir.String(c), "rev-parse", "--show-toplevel")
+	if err != nil {
+		return fmt.Errorf("failed to determine git root: %v", err)
+	}
+	gitRoot = strings.TrimSpace(gitRoot)
+
+	ctx := cuecontext.New()
+	manifestDef := loadSchema(ctx, "Manifest")
+	if err := manifestDef.Err(); err != nil {
+		return fmt.Errorf("failed to load #Manifest definition: %v", err)
+	}
+	overlayDirs, err := overlayDirsFromFlags(c)
+	if err != nil {
+		return err
+	}
+	bh, err := newBuildHelper()
+	if err != nil {
+		return fmt.Errorf("failed to create build helper: %v", err)
+	}
+	vr, err := newVersionResolver(resolverConfig{
+		bh:        bh,
+		allowPATH: !flagTestNoPath.Bool(c),
+		debug:     flagDebug.Bool(c),
+	})
+	if err != nil {
+		return fmt.Errorf("could not create version resolver: %v", err)
+	}
+	// vet only uses the parts of a module tester that load manifests
+	mt := &moduleTester{
+		gitRoot:     gitRoot,
+		overlayDirs: overlayDirs,
+		runtime:     ctx,
+		manifestDef: manifestDef,
+	}
+
+	roots, err := findModuleRoots(gitRoot)
+	if err != nil {
+		return fmt.Errorf("failed to find CUE modules in %s: %v", gitRoot, err)
+	}
+	if len(roots) == 0 {
+		return fmt.Errorf("could not find any CUE module roots under %s", gitRoot)
+	}
+	problems := 0
+	for _, root := range roots {
+		for _, p := range mt.vetModule(vr, root) {
+			fmt.Fprintln(os.Stderr, p)
+			problems++
+		}
+	}
+	if problems > 0 {
+		// we will have printed everything we need to
+		exit()
+	}
+	return nil
+}
+
+// vetModule returns the problems with the tests of the module at root, each
+// prefixed by the file in question relative to mt.gitRoot.
+func (mt *moduleTester) vetModule(vr *versionResolver, root string) []string {
+	rel := func(p string) string {
+		if r, err := filepath.Rel(mt.gitRoot, p); err == nil && !strings.HasPrefix(r, "..") {
+			return r
+		}
+		return p
+	}
+	testerRel, _ := filepath.Rel(mt.gitRoot, root)
+	layers, _ := mt.manifestLayers(root, testerRel, "", "")
+	var problems []string
+	manifest, err := mt.loadValidManifest(layers)
+	if err != nil {
+		return append(problems, fmt.Sprintf("%s: %v", rel(layers[len(layers)-1]), err))
+	}
+	if _, _, err := manifestTimeouts(manifest); err != nil {
+		problems = append(problems, fmt.Sprintf("%s: %v", rel(layers[len(layers)-1]), err))
+	}
+	for _, v := range manifest.Versions {
+		if err := vr.check(v); err != nil {
+			problems = append(problems, fmt.Sprintf("%s: invalid version in Versions: %v", rel(layers[len(layers)-1]), err))
+		}
+	}
+	scripts, err := layerScripts(layers)
+	if err != nil {
+		return append(problems, fmt.Sprintf("%s: %v", rel(root), err))
+	}
+	for _, s := range scripts {
+		problems = append(problems, vetScript(s, rel(s))...)
+	}
+	return problems
+}
+
+// vetScript returns the problems with the test script at path s, each
+// prefixed by name and the line number in question, if any.
+func vetScript(s, name string) []string {
+	archive, err := txtar.ParseFile(s)
+	if err != nil {
+		return []string{fmt.Sprintf("%s: failed to parse txtar archive: %v", name, err)}
+	}
+	var problems []string
+	for _, f := range repoPaths(archive) {
+		problems = append(problems, fmt.Sprintf("%s: invalid file path %s; %s/ is reserved for the repository under test", name, f, repoDir))
+	}
+
+	script := string(archive.Comment)
+
+	// refs are the paths, relative to $WORK, that the script refers to via
+	// the arguments of its commands. Scripts start in the copy of the
+	// repository, so relative paths only refer to files of the archive once
+	// the script has changed to a directory relative to $WORK, which cwd
+	// tracks.
+	var refs []string
+	cwd := ""
+	for i, line := range strings.Split(script, "\n") {
+		args := scriptLineArgs(line)
+		for len(args) > 0 && strings.HasPrefix(args[0], "[") && strings.HasSuffix(args[0], "]") {
+			cond := strings.TrimSpace(args[0][1 : len(args[0])-1])
+			cond = strings.TrimSpace(strings.TrimPrefix(cond, "!"))
+			if !knownScriptCondition(cond) {
+				problems = append(problems, fmt.Sprintf("%s:%d: unknown condition %q", name, i+1, cond))
+			}
+			args = args[1:]
+		}
+		if len(args) > 0 && args[0] == "!" {
+			args = args[1:]
+		}
+		if len(args) == 0 {
+			continue
+		}
+		if !scriptCommands[args[0]] {
+			problems = append(problems, fmt.Sprintf("%s:%d: unknown command %q", name, i+1, args[0]))
+		}
+		for _, arg := range args[1:] {
+			refs = append(refs, scriptArgPaths(arg, cwd)...)
+		}
+		if args[0] == "cd" && len(args) == 2 {
+			cwd = ""
+			if ps := scriptArgPaths(args[1], cwd); len(ps) > 0 {
+				cwd = ps[0]
+			}
+		}
+	}
+
+	// A file is referred to if the script names it or a directory that
+	// contains it, including by changing to that directory
+	var unused []string
+	for _, f := range archive.Files {
+		if !scriptRefersTo(refs, f.Name) {
+			unused = append(unused, f.Name)
+		}
+	}
+	sort.Strings(unused)
+	for _, f := range unused {
+		problems = append(problems, fmt.Sprintf("%s: file %s is not used by the script", name, f))
+	}
+	return problems
+}
+
+// scriptRefersTo reports whether the file name of a script's archive, or any
+// of its parent directories other than $WORK itself, is among refs.
+func scriptRefersTo(refs []string, name string) bool {
+	for p := path.Clean(name); p != "." && p != "/"; p = path.Dir(p) {
+		for _, r := range refs {
+			if r == p {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// scriptArgPaths returns the paths, relative to $WORK, that the argument arg
+// of a script command might refer to, when the script is in the directory cwd
+// relative to $WORK, or in the repository if cwd is empty. Quotes are
+// ignored, and the value of a NAME=value argument is also considered.
+func scriptArgPaths(arg, cwd string) []string {
+	arg = strings.Trim(arg, `'"`)
+	words := []string{arg}
+	if _, v, ok := strings.Cut(arg, "="); ok {
+		words = append(words, v)
+	}
+	var res []string
+	for _, w := range words {
+		for _, work := range []string{"$WORK", "${WORK}"} {
+			if w == work || strings.HasPrefix(w, work+"/") {
+				res = append(res, path.Clean("./"+strings.TrimPrefix(w, work)))
+			}
+		}
+		if cwd != "" && w != "" && !strings.HasPrefix(w, "$") && !path.IsAbs(w) {
+			res = append(res, path.Join(cwd, w))
+		}
+	}
+	return res
+}
+
+// scriptLineArgs splits a line of a test script into its words, up to any
+// comment. Unlike testscript, it does not interpret quotes, which is enough
+// to find conditions and commands.
+func scriptLineArgs(line string) []string {
+	var args []string
+	for _, f := range strings.Fields(line) {
+		if strings.HasPrefix(f, "#") {
+			break
+		}
+		args = append(args, f)
+	}
+	return args
+}
@@ -0,0 +1,125 @@
+// Copyright 2023 The CUE Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package scriptparams defines the testscript parameters with which unity runs
+// the test scripts of a module.
+//
+// unity runs test scripts either in process, or via go test in a temporary
+// module, into which unity copies the source of this package. Both therefore
+// share the same code, so this package must only depend on the standard
+// library and testscript.
+package scriptparams
+
+import (
+	_ "embed"
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/rogpeppe/go-internal/testscript"
+)
+
+// Source is the source of this package, which unity copies into the
+// temporary module that runs test scripts via go test.
+//
+//go:embed scriptparams.go
+var Source string
+
+// RepoDir is the directory within the working directory of a test script
+// that contains the copy of the repository under test.
+const RepoDir = "repo"
+
+// Config describes how to run the test scripts of a module.
+type Config struct {
+	// ManifestDir is the directory that contains the test scripts
+	ManifestDir string
+
+	// WorkdirRoot is the directory within which scripts run
+	WorkdirRoot string
+
+	// RelPath is the path of the module relative to the repository
+	// under test
+	RelPath string
+
+	// CUEPath is the path to the cue binary under test
+	CUEPath string
+
+	// StatsDir is the directory to which cue writes evaluator stats
+	StatsDir string
+
+	// Update indicates that cmp failures update the test scripts
+	Update bool
+
+	// Env are the environment settings of the version under test, in
+	// NAME=value form
+	Env []string
+}
+
+// Params returns the testscript parameters for c.
+func (c Config) Params() testscript.Params {
+	return testscript.Params{
+		UpdateScripts: c.Update,
+		// TODO(mvdan): Consider using RequireExplicitExec in the future.
+		Dir:         c.ManifestDir,
+		WorkdirRoot: c.WorkdirRoot,
+		Setup: func(env *testscript.Env) error {
+			// Ensure that cue is on the PATH
+			newPath := filepath.Dir(c.CUEPath) + string(os.PathListSeparator) + env.Getenv("PATH")
+			env.Setenv("PATH", newPath)
+
+			// Apply the environment settings of the version under test, such
+			// that they apply to every cue invocation
+			for _, kv := range c.Env {
+				k, v, _ := strings.Cut(kv, "=")
+				env.Setenv(k, v)
+			}
+
+			// Set the working directory to be module
+			env.Cd = filepath.Join(env.WorkDir, RepoDir, c.RelPath)
+			return nil
+		},
+		// TODO(mvdan): We should transition to `exec cue`, which has multiple
+		// advantages over a plain command.
+		Cmds: map[string]func(ts *testscript.TestScript, neg bool, args []string){
+			"cue": CmdCUE(c.CUEPath, c.StatsDir),
+		},
+	}
+}
+
+// CmdCUE returns the cue command of test scripts, which runs the cue binary
+// at cuePath, writing evaluator stats to statsDir.
+func CmdCUE(cuePath, statsDir string) func(ts *testscript.TestScript, neg bool, args []string) {
+	return func(ts *testscript.TestScript, neg bool, args []string) {
+		if len(args) < 1 {
+			ts.Fatalf("usage: cue subcommand ...")
+		}
+		// Use a random stats filename for each cmd/cue invocation,
+		// so that if a single script runs cmd/cue multiple times,
+		// we end up with multiple stats files.
+		ts.Setenv("CUE_STATS_FILE", filepath.Join(statsDir, fmt.Sprintf("%d.json", rand.Uint32())))
+		err := ts.Exec(cuePath, args...)
+		if err != nil {
+			ts.Logf("[%v]\n", err)
+			if !neg {
+				ts.Fatalf("unexpected cue command failure")
+			}
+		} else {
+			if neg {
+				ts.Fatalf("unexpected cue command success")
+			}
+		}
+	}
+}
@@ -24,6 +24,11 @@ import (
 
 // Manifest defines the schema of the manifest that a module must define to be
 // added to the unity test setup
+//
+// When an overlay is layered over a module's own manifest, each top-level
+// field of the overlay's manifest replaces the same field of the module's
+// manifest instead of being unified with it. For example, an overlay that
+// declares GoTests replaces all of the module's GoTests.
 type Manifest struct {
 	// Versions is a list of CUE versions that are known good to the module.
 	// That is to say, running unity test with the list of versions should
@@ -41,13 +46,84 @@ type Manifest struct {
 	// GoTest is a map describing which Go tests should be run.
 	// Each map key is a Go package pattern, such as `./...`.
 	GoTests map[string]GoTestFlags
+
+	// Timeout is the maximum duration, e.g. `10m`, of testing the module
+	// against a CUE version, including its Go tests. Exceeding it is
+	// reported as a TIMEOUT, as opposed to a failure.
+	Timeout string `json:",omitempty" cue:"=~ \"^[0-9]\""`
+
+	// ScriptTimeouts maps the name of a test script, without its file
+	// extension, to the maximum duration of that script.
+	ScriptTimeouts map[string]string `json:",omitempty"`
+
+	// Network indicates that the test scripts and Go tests of the module
+	// need network access. In safe mode, they otherwise run in a container
+	// without a network.
+	Network bool `json:",omitempty"`
+
+	// Tags is a list of labels that describe the module, e.g. `kubernetes`,
+	// `large` or `gotests`. A corpus run can be restricted to the modules
+	// with a tag via --tags.
+	Tags []string `json:",omitempty"`
 }
 
 // GoTestFlags holds the flags passed to `go test`, such as `-run`.
 type GoTestFlags struct {
+	// Run is a list of regular expressions passed as `-run` flags.
 	Run []string
-	// TODO(mvdan): enable and test Skip once Go 1.20 is out
-	// Skip []string
+
+	// Skip is a list of regular expressions passed as `-skip` flags.
+	// It requires Go 1.20 or later.
+	Skip []string `json:",omitempty"`
+
+	// Tags is a list of build tags passed as `-tags`.
+	Tags []string `json:",omitempty"`
+
+	// Timeout is passed as `-timeout`, e.g. `5m`.
+	Timeout string `json:",omitempty" cue:"=~ \"^[0-9]\""`
+
+	// Race enables the race detector via `-race`.
+	Race bool `json:",omitempty"`
+
+	// Short tells long-running tests to shorten their run time via `-short`.
+	Short bool `json:",omitempty"`
+
+	// Cover enables coverage analysis via `-cover`.
+	Cover bool `json:",omitempty"`
+
+	// Env holds extra environment variables for `go test`,
+	// which are also inherited by the test binaries.
+	Env map[string]string `json:",omitempty"`
+}
+
+// Corpus defines the schema of a corpus file, which declares the projects of
+// a corpus as an alternative to adding them as git submodules
+type Corpus struct {
+	// Projects maps the path of each project within the corpus, e.g.
+	// `projects/github.com/cue-sh/cfn-cue`, to its declaration. As with the
+	// path of a submodule, it is the path of the project's overlays within
+	// the directory passed to --overlay.
+	Projects map[string]CorpusProject
+}
+
+// CorpusProject declares a project of a corpus.
+type CorpusProject struct {
+	// Repo is the git URL from which the project is cloned. A path that
+	// starts with ./ or ../ is relative to the corpus file.
+	Repo string
+
+	// Commit is the full hash of the commit of the project to test.
+	Commit string `cue:"=~ \"^[0-9a-f]{40}$\""`
+
+	// Modules is a list of the paths of the project's CUE modules, relative
+	// to its root. If empty, the modules are found by searching the project
+	// for cue.mod directories.
+	Modules []string `json:",omitempty"`
+
+	// Overlay is a directory, relative to the corpus file, that holds the
+	// overlays of the project. The overlay of a module is the directory at
+	// its path within the project, and takes precedence over --overlay.
+	Overlay string `json:",omitempty"`
 }
 
 //go:embed *.cue
@@ -6,6 +6,11 @@ package unity
 
 // Manifest defines the schema of the manifest that a module must define to be
 // added to the unity test setup
+//
+// When an overlay is layered over a module's own manifest, each top-level
+// field of the overlay's manifest replaces the same field of the module's
+// manifest instead of being unified with it. For example, an overlay that
+// declares GoTests replaces all of the module's GoTests.
 #Manifest: {
 	// Versions is a list of CUE versions that are known good to the module.
 	// That is to say, running unity test with the list of versions should
@@ -23,9 +28,82 @@ package unity
 	// GoTest is a map describing which Go tests should be run.
 	// Each map key is a Go package pattern, such as `./...`.
 	GoTests: {[string]: #GoTestFlags} @go(,map[string]GoTestFlags)
+
+	// Timeout is the maximum duration, e.g. `10m`, of testing the module
+	// against a CUE version, including its Go tests. Exceeding it is
+	// reported as a TIMEOUT, as opposed to a failure.
+	Timeout?: string & =~"^[0-9]"
+
+	// ScriptTimeouts maps the name of a test script, without its file
+	// extension, to the maximum duration of that script.
+	ScriptTimeouts?: {[string]: string} @go(,map[string]string)
+
+	// Network indicates that the test scripts and Go tests of the module
+	// need network access. In safe mode, they otherwise run in a container
+	// without a network.
+	Network?: bool
+
+	// Tags is a list of labels that describe the module, e.g. `kubernetes`,
+	// `large` or `gotests`. A corpus run can be restricted to the modules
+	// with a tag via --tags.
+	Tags?: [...string] @go(,[]string)
 }
 
 // GoTestFlags holds the flags passed to `go test`, such as `-run`.
 #GoTestFlags: {
+	// Run is a list of regular expressions passed as `-run` flags.
 	Run: [...string] @go(,[]string)
+
+	// Skip is a list of regular expressions passed as `-skip` flags.
+	// It requires Go 1.20 or later.
+	Skip?: [...string] @go(,[]string)
+
+	// Tags is a list of build tags passed as `-tags`.
+	Tags?: [...string] @go(,[]string)
+
+	// Timeout is passed as `-timeout`, e.g. `5m`.
+	Timeout?: string & =~"^[0-9]"
+
+	// Race enables the race detector via `-race`.
+	Race?: bool
+
+	// Short tells long-running tests to shorten their run time via `-short`.
+	Short?: bool
+
+	// Cover enables coverage analysis via `-cover`.
+	Cover?: bool
+
+	// Env holds extra environment variables for `go test`,
+	// which are also inherited by the test binaries.
+	Env?: {[string]: string} @go(,map[string]string)
+}
+
+// Corpus defines the schema of a corpus file, which declares the projects of
+// a corpus as an alternative to adding them as git submodules
+#Corpus: {
+	// Projects maps the path of each project within the corpus, e.g.
+	// `projects/github.com/cue-sh/cfn-cue`, to its declaration. As with the
+	// path of a submodule, it is the path of the project's overlays within
+	// the directory passed to --overlay.
+	Projects: {[string]: #CorpusProject} @go(,map[string]CorpusProject)
+}
+
+// CorpusProject declares a project of a corpus.
+#CorpusProject: {
+	// Repo is the git URL from which the project is cloned. A path that
+	// starts with ./ or ../ is relative to the corpus file.
+	Repo: string
+
+	// Commit is the full hash of the commit of the project to test.
+	Commit: string & =~"^[0-9a-f]{40}$"
+
+	// Modules is a list of the paths of the project's CUE modules, relative
+	// to its root. If empty, the modules are found by searching the project
+	// for cue.mod directories.
+	Modules?: [...string] @go(,[]string)
+
+	// Overlay is a directory, relative to the corpus file, that holds the
+	// overlays of the project. The overlay of a module is the directory at
+	// its path within the project, and takes precedence over --overlay.
+	Overlay?: string
 }